@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SKUStatus is the latest price, eviction and placement data of an instance
+// type in a region.
+type SKUStatus struct {
+	Region          string                    `json:"region"`
+	Instance        string                    `json:"instance"`
+	OS              string                    `json:"os"`
+	RegularPrice    float64                   `json:"regularPrice"`
+	SpotPrice       float64                   `json:"spotPrice"`
+	Reserved1Y      float64                   `json:"reserved1yPrice,omitempty"`
+	Reserved3Y      float64                   `json:"reserved3yPrice,omitempty"`
+	SavingsPlan1Y   float64                   `json:"savingsPlan1yPrice,omitempty"`
+	SavingsPlan3Y   float64                   `json:"savingsPlan3yPrice,omitempty"`
+	Baseline        string                    `json:"baseline"`
+	BaselinePrice   float64                   `json:"baselinePrice"`
+	Currency        string                    `json:"currency"`
+	Discount        float64                   `json:"discount"`
+	EvictionBand    EvictionBand              `json:"evictionBand"`
+	EvictionRate    float64                   `json:"evictionRate"`
+	PlacementScores map[string]map[string]int `json:"placementScores"` // by subscription and zone
+	Version         int                       `json:"version"`
+	UpdatedAt       time.Time                 `json:"updatedAt"`
+}
+
+// NodepoolStatus is a scored nodepool together with the priority it was given.
+type NodepoolStatus struct {
+	Nodepool
+	Smoothed  *SmoothedInputs `json:"smoothed,omitempty"`
+	Cluster   string          `json:"cluster"`
+	Pattern   string          `json:"pattern"`
+	Priority  *int            `json:"priority"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// SmoothedInputs are the scoring inputs of a nodepool after smoothing, the
+// ones it was scored with.
+type SmoothedInputs struct {
+	PlacementScore int     `json:"placementScore"`
+	EvictionRate   float64 `json:"evictionRate"`
+	Discount       float64 `json:"discount"`
+}
+
+type clusterPriorities struct {
+	Priorities map[int][]string `json:"priorities"`
+	UpdatedAt  time.Time        `json:"updatedAt"`
+}
+
+type clusterSnapshot struct {
+	nodepools  []NodepoolStatus
+	priorities clusterPriorities
+}
+
+// apiState keeps the results of the latest reconcile for the read-only API.
+type apiState struct {
+	mu       sync.RWMutex
+	clusters map[string]clusterSnapshot
+	skus     map[string]SKUStatus
+}
+
+var latest = &apiState{
+	clusters: make(map[string]clusterSnapshot),
+	skus:     make(map[string]SKUStatus),
+}
+
+func (s *apiState) recordSKU(sku SKUStatus) {
+	s.mu.Lock()
+	s.skus[regionSKUKey(sku.Region, osSKUKey(sku.Instance, sku.OS))] = sku
+	s.mu.Unlock()
+}
+
+// recordPriorities stores the nodepools of a cluster with their smoothed
+// inputs, if any, and the priorities computed for them.
+func (s *apiState) recordPriorities(cluster string, nodePools, smoothed NodepoolMap, priorities map[int][]string) {
+	now := time.Now()
+
+	patternPriority := make(map[string]int)
+	for priority, patterns := range priorities {
+		for _, pattern := range patterns {
+			patternPriority[pattern] = priority
+		}
+	}
+
+	nodepools := make([]NodepoolStatus, 0, len(nodePools))
+	for key, np := range nodePools {
+		status := NodepoolStatus{
+			Nodepool:  np,
+			Cluster:   cluster,
+			Pattern:   nodeGroupPattern(np.Name),
+			UpdatedAt: now,
+		}
+		if in, ok := smoothed[key]; ok {
+			status.Smoothed = &SmoothedInputs{PlacementScore: in.PlacementScore, EvictionRate: in.EvictionRate, Discount: in.Discount}
+		}
+		if priority, ok := patternPriority[status.Pattern]; ok {
+			status.Priority = &priority
+		}
+		nodepools = append(nodepools, status)
+	}
+	sort.Slice(nodepools, func(i, j int) bool { return nodepools[i].Name < nodepools[j].Name })
+
+	s.mu.Lock()
+	s.clusters[cluster] = clusterSnapshot{
+		nodepools:  nodepools,
+		priorities: clusterPriorities{Priorities: priorities, UpdatedAt: now},
+	}
+	s.mu.Unlock()
+}
+
+func dataTimestamps() map[string]*time.Time {
+	health.mu.RLock()
+	defer health.mu.RUnlock()
+
+	timestamps := make(map[string]*time.Time)
+	for _, source := range dataSources {
+		timestamps[source] = timePtr(health.sources[source])
+	}
+	return timestamps
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		lg.WithError(err).Error("failed to write API response")
+	}
+}
+
+// nodepoolsHandler serves the scoring inputs and priority of every nodepool,
+// optionally filtered with ?cluster=.
+func nodepoolsHandler(w http.ResponseWriter, r *http.Request) {
+	cluster := r.URL.Query().Get("cluster")
+
+	latest.mu.RLock()
+	nodepools := []NodepoolStatus{}
+	for name, snapshot := range latest.clusters {
+		if cluster == "" || cluster == name {
+			nodepools = append(nodepools, snapshot.nodepools...)
+		}
+	}
+	latest.mu.RUnlock()
+
+	sort.SliceStable(nodepools, func(i, j int) bool { return nodepools[i].Cluster < nodepools[j].Cluster })
+
+	writeJSON(w, struct {
+		Nodepools      []NodepoolStatus      `json:"nodepools"`
+		DataTimestamps map[string]*time.Time `json:"dataTimestamps"`
+	}{nodepools, dataTimestamps()})
+}
+
+// prioritiesHandler serves the priorities computed for every cluster.
+func prioritiesHandler(w http.ResponseWriter, _ *http.Request) {
+	latest.mu.RLock()
+	clusters := make(map[string]clusterPriorities, len(latest.clusters))
+	for name, snapshot := range latest.clusters {
+		clusters[name] = snapshot.priorities
+	}
+	latest.mu.RUnlock()
+
+	writeJSON(w, struct {
+		Clusters map[string]clusterPriorities `json:"clusters"`
+	}{clusters})
+}
+
+// skusHandler serves the latest data of every instance type, optionally
+// filtered with ?region=.
+func skusHandler(w http.ResponseWriter, r *http.Request) {
+	region := r.URL.Query().Get("region")
+
+	latest.mu.RLock()
+	skus := []SKUStatus{}
+	for _, sku := range latest.skus {
+		if region == "" || region == sku.Region {
+			skus = append(skus, sku)
+		}
+	}
+	latest.mu.RUnlock()
+
+	sort.Slice(skus, func(i, j int) bool {
+		if skus[i].Region != skus[j].Region {
+			return skus[i].Region < skus[j].Region
+		}
+		if skus[i].Instance != skus[j].Instance {
+			return skus[i].Instance < skus[j].Instance
+		}
+		return skus[i].OS < skus[j].OS
+	})
+
+	writeJSON(w, struct {
+		SKUs           []SKUStatus           `json:"skus"`
+		DataTimestamps map[string]*time.Time `json:"dataTimestamps"`
+	}{skus, dataTimestamps()})
+}
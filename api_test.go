@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodepoolsHandler(t *testing.T) {
+	nodePools := NodepoolMap{
+		"general": {Name: "general", Instance: "Standard_D4s_v5", Type: "Regular"},
+		"spota":   {Name: "spota", Instance: "Standard_D4s_v5", PlacementScore: 100, ZonePlacementScores: map[string]int{"1": 100}, Type: "Spot"},
+	}
+	latest.recordPriorities("aks-api-test", nodePools, nil, map[int][]string{
+		30: {"^aks-spota-[0-9]+-vmss$"},
+		29: {"^aks-general-[0-9]+-vmss$"},
+	})
+
+	rec := httptest.NewRecorder()
+	nodepoolsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nodepools?cluster=aks-api-test", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Nodepools []NodepoolStatus `json:"nodepools"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Len(t, body.Nodepools, 2)
+	assert.Equal(t, "general", body.Nodepools[0].Name)
+	assert.Equal(t, 29, *body.Nodepools[0].Priority)
+	assert.Equal(t, "spota", body.Nodepools[1].Name)
+	assert.Equal(t, 30, *body.Nodepools[1].Priority)
+	assert.Equal(t, map[string]int{"1": 100}, body.Nodepools[1].ZonePlacementScores)
+
+	rec = httptest.NewRecorder()
+	prioritiesHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/priorities", nil))
+	assert.Contains(t, rec.Body.String(), `"aks-api-test":{"priorities":{"29":["^aks-general-[0-9]+-vmss$"],"30":["^aks-spota-[0-9]+-vmss$"]}`)
+}
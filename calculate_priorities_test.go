@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,15 +23,15 @@ func TestCalculatePriority(t *testing.T) {
 	}
 
 	// Call the function
-	priorities := calculatePriority(nodePools)
+	priorities := calculatePriority(nodePools, weightedScorer{weights: scoringPresets["weighted"]})
 
 	// Assert the results
 	expectedPriorities := map[int][]string{
-		71: {".*general.*", ".*spotc.*"},
-		72: {".*spotd.*"},
-		79: {".*spota.*"},
-		87: {".*spotb.*"},
-		0:  {".*spote.*", ".*spotg.*", ".*spotf.*"},
+		23: {"^aks-general-[0-9]+-vmss$", "^aks-spotc-[0-9]+-vmss$"},
+		24: {"^aks-spotd-[0-9]+-vmss$"},
+		25: {"^aks-spote-[0-9]+-vmss$", "^aks-spotf-[0-9]+-vmss$", "^aks-spotg-[0-9]+-vmss$"},
+		28: {"^aks-spota-[0-9]+-vmss$"},
+		30: {"^aks-spotb-[0-9]+-vmss$"},
 	}
 	if !reflect.DeepEqual(expectedPriorities, priorities) {
 		assert.Equal(t, expectedPriorities, priorities)
@@ -49,17 +50,211 @@ func TestVersions(t *testing.T) {
 	}
 
 	// Call the function
-	priorities := calculatePriority(nodePools)
+	priorities := calculatePriority(nodePools, weightedScorer{weights: scoringPresets["weighted"]})
 
 	// Assert the results
 	expectedPriorities := map[int][]string{
-		71: {".*general.*"},
-		75: {".*spota_v2.*"},
-		79: {".*spota_v6.*"},
-		87: {".*spotb_v2.*"},
-		91: {".*spotb_v6.*"},
+		23: {"^aks-general-[0-9]+-vmss$"},
+		27: {"^aks-spota_v2-[0-9]+-vmss$"},
+		30: {"^aks-spotb_v2-[0-9]+-vmss$"},
+		31: {"^aks-spota_v6-[0-9]+-vmss$"},
+		34: {"^aks-spotb_v6-[0-9]+-vmss$"},
 	}
 	if !reflect.DeepEqual(expectedPriorities, priorities) {
 		assert.Equal(t, expectedPriorities, priorities)
 	}
 }
+
+func TestLexicographicScorer(t *testing.T) {
+
+	// Define sample node pools
+	nodePools := NodepoolMap{
+		"spota": {Name: "spota", Discount: 0.9, EvictionRate: 0.2, PlacementScore: 100, Version: 5},
+		"spotb": {Name: "spotb", Discount: 0.5, EvictionRate: 0.05, PlacementScore: 100, Version: 5},
+		"spotc": {Name: "spotc", Discount: 0.9, EvictionRate: 0.05, PlacementScore: 50, Version: 5},
+		"spotd": {Name: "spotd", Discount: 0.9, EvictionRate: 0.05, PlacementScore: 50, Version: 5},
+	}
+
+	// Call the function
+	priorities := calculatePriority(nodePools, lexicographicScorer{order: defaultLexicographicOrder})
+
+	// Assert the results
+	expectedPriorities := map[int][]string{
+		1: {"^aks-spotc-[0-9]+-vmss$", "^aks-spotd-[0-9]+-vmss$"},
+		2: {"^aks-spota-[0-9]+-vmss$"},
+		3: {"^aks-spotb-[0-9]+-vmss$"},
+	}
+	assert.Equal(t, expectedPriorities, priorities)
+}
+
+func TestNewScorer(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("scoring.strategy", "cost-first")
+	cfg.Set("scoring.weights.placement", 0.5)
+
+	scorer, err := newScorer(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, weightedScorer{weights: ScoringWeights{Availability: 0.1, Discount: 0.6, Placement: 0.5, Version: 0.1}}, scorer)
+
+	cfg.Set("scoring.strategy", "cheapest")
+	_, err = newScorer(cfg)
+	assert.Error(t, err)
+
+	cfg.Set("scoring.strategy", "lexicographic")
+	cfg.Set("scoring.order", []string{"discount", "placement"})
+	scorer, err = newScorer(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, lexicographicScorer{order: []string{"discount", "placement"}}, scorer)
+
+	// The scorer used before any config is loaded has every wrapper
+	fallback := defaultScorer().(regularPlacementScorer).Scorer.(maxPriceScorer).Scorer
+	assert.IsType(t, trendScorer{}, fallback)
+}
+
+func TestEnforceSpotSafety(t *testing.T) {
+
+	// Define sample node pools
+	nodePools := NodepoolMap{
+		"general": {Name: "general", Type: "Regular"},
+		"spota":   {Name: "spota", Type: "Spot"},
+		"spotb":   {Name: "spotb", Type: "Spot"},
+	}
+	priorities := map[int][]string{
+		30: {"^aks-general-[0-9]+-vmss$", "^aks-spota-[0-9]+-vmss$"},
+		20: {"^aks-spotb-[0-9]+-vmss$"},
+	}
+
+	assert.False(t, checkSpotIsSafe(nodePools, priorities))
+
+	_, err := enforceSpotSafety("refuse", nodePools, priorities)
+	assert.Error(t, err)
+
+	alerted, err := enforceSpotSafety("alert", nodePools, priorities)
+	assert.NoError(t, err)
+	assert.Equal(t, priorities, alerted)
+
+	demoted, err := enforceSpotSafety("demote", nodePools, priorities)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]string{
+		30: {"^aks-spota-[0-9]+-vmss$"},
+		29: {"^aks-general-[0-9]+-vmss$"},
+		20: {"^aks-spotb-[0-9]+-vmss$"},
+	}, demoted)
+	assert.True(t, checkSpotIsSafe(nodePools, demoted))
+
+	// Lower spot nodepools make room instead of tying with the demoted one
+	demoted, err = enforceSpotSafety("demote", nodePools, map[int][]string{
+		30: {"^aks-general-[0-9]+-vmss$", "^aks-spota-[0-9]+-vmss$"},
+		29: {"^aks-spotb-[0-9]+-vmss$"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]string{
+		30: {"^aks-spota-[0-9]+-vmss$"},
+		29: {"^aks-general-[0-9]+-vmss$"},
+		28: {"^aks-spotb-[0-9]+-vmss$"},
+	}, demoted)
+
+	// Priorities stay at 1 or more
+	demoted, err = enforceSpotSafety("demote", nodePools, map[int][]string{
+		1: {"^aks-general-[0-9]+-vmss$", "^aks-spota-[0-9]+-vmss$", "^aks-spotb-[0-9]+-vmss$"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]string{
+		2: {"^aks-spota-[0-9]+-vmss$", "^aks-spotb-[0-9]+-vmss$"},
+		1: {"^aks-general-[0-9]+-vmss$"},
+	}, demoted)
+}
+
+func TestReloadSafetyPolicy(t *testing.T) {
+	t.Cleanup(func() { activeSafetyPolicy.policy = "demote" })
+
+	cfg := viper.New()
+	cfg.Set("safety.policy", "alert")
+	assert.NoError(t, reloadSafetyPolicy(cfg))
+	assert.Equal(t, "alert", currentSafetyPolicy())
+
+	// Unknown policies are rejected and the previous one is kept
+	cfg.Set("safety.policy", "demoted")
+	assert.Error(t, reloadSafetyPolicy(cfg))
+	assert.Equal(t, "alert", currentSafetyPolicy())
+
+	_, err := enforceSpotSafety("demoted", NodepoolMap{
+		"general": {Name: "general", Type: "Regular"},
+		"spota":   {Name: "spota", Type: "Spot"},
+	}, map[int][]string{10: {"^aks-general-[0-9]+-vmss$", "^aks-spota-[0-9]+-vmss$"}})
+	assert.Error(t, err)
+}
+
+func TestRegularPlacement(t *testing.T) {
+	nodePools := NodepoolMap{
+		"general": {Name: "general", Type: "Regular", PlacementScore: 100, Version: 5},
+		"spota":   {Name: "spota", Type: "Spot"},
+		"spotb":   {Name: "spotb", Type: "Spot"},
+		"spotc":   {Name: "spotc", Type: "Spot"},
+	}
+	scorer := fixedScorer{"general": 40, "spota": 35, "spotb": 25, "spotc": 20}
+
+	tests := []struct {
+		placement string
+		expected  map[string]int
+	}{
+		{regularLast, map[string]int{"general": 19, "spota": 35, "spotb": 25, "spotc": 20}},
+		{regularThreshold, map[string]int{"general": 29, "spota": 35, "spotb": 24, "spotc": 19}},
+		{regularScored, map[string]int{"general": 40, "spota": 35, "spotb": 25, "spotc": 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.placement, func(t *testing.T) {
+			cfg := viper.New()
+			cfg.Set("regular.placement", tt.placement)
+			cfg.Set("regular.threshold", 30)
+			placed, err := newRegularPlacementScorer(cfg, scorer)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, placed.Score(nodePools))
+		})
+	}
+
+	// Placements below 1 shift every priority up
+	for placement, expected := range map[string]map[string]int{
+		regularLast:      {"general": 1, "spota": 4, "spotb": 3, "spotc": 2},
+		regularThreshold: {"general": 2, "spota": 4, "spotb": 3, "spotc": 1},
+	} {
+		ranked := regularPlacementScorer{Scorer: fixedScorer{"general": 4, "spota": 3, "spotb": 2, "spotc": 1}, placement: placement, threshold: 2}
+		assert.Equal(t, expected, ranked.Score(nodePools), placement)
+	}
+
+	// The threshold is scaled like the penalties, one rank with lexicographic
+	cfg := viper.New()
+	cfg.Set("regular.placement", regularThreshold)
+	cfg.Set("regular.threshold", 30)
+	placed, err := newRegularPlacementScorer(cfg, newTrendScorer(cfg, lexicographicScorer{order: defaultLexicographicOrder}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, placed.(regularPlacementScorer).threshold)
+
+	cfg.Set("regular.placement", "first")
+	_, err = newRegularPlacementScorer(cfg, scorer)
+	assert.Error(t, err)
+}
+
+func TestScoredRegularPlacement(t *testing.T) {
+	nodePools := NodepoolMap{
+		"cheap":  {Name: "cheap", Type: "Regular", PlacementScore: 100, Price: 0.1},
+		"pricey": {Name: "pricey", Type: "Regular", PlacementScore: 100, Price: 0.4},
+		"spota":  {Name: "spota", Type: "Spot", PlacementScore: 100, Discount: 0.8},
+	}
+	scorer := regularPlacementScorer{Scorer: lexicographicScorer{order: defaultLexicographicOrder}, placement: regularScored}
+	assert.Equal(t, map[string]int{"cheap": 2, "pricey": 1, "spota": 3}, scorer.Score(nodePools))
+
+	// The inputs of the nodepools are left untouched
+	assert.Zero(t, nodePools["cheap"].Discount)
+}
+
+// fixedScorer returns the same scores for any nodepools.
+type fixedScorer map[string]int
+
+func (s fixedScorer) Score(NodepoolMap) map[string]int {
+	scores := make(map[string]int, len(s))
+	for key, score := range s {
+		scores[key] = score
+	}
+	return scores
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// ClusterConfig describes an AKS cluster whose priorities are managed by the
+// monitor and where its cluster-autoscaler configmap lives.
+type ClusterConfig struct {
+	Name           string `mapstructure:"name"`
+	SubscriptionID string `mapstructure:"subscriptionId"`
+	ResourceGroup  string `mapstructure:"resourceGroup"`
+	// Kubeconfig and Context select the Kubernetes API to write to, the
+	// in-cluster config (or $KUBECONFIG) is used when both are empty.
+	Kubeconfig         string `mapstructure:"kubeconfig"`
+	Context            string `mapstructure:"context"`
+	ConfigMapName      string `mapstructure:"configmapName"`
+	ConfigMapNamespace string `mapstructure:"configmapNamespace"`
+}
+
+// loadClusters reads the clusters list from config, falling back to the
+// single cluster described by subscription.id, resource.group and cluster.name.
+func loadClusters(cfg *viper.Viper) ([]ClusterConfig, error) {
+	var clusters []ClusterConfig
+
+	if cfg.IsSet("clusters") {
+		if err := cfg.UnmarshalKey("clusters", &clusters); err != nil {
+			return nil, fmt.Errorf("failed to parse clusters: %w", err)
+		}
+	} else {
+		clusters = []ClusterConfig{{
+			Name:           cfg.GetString("cluster.name"),
+			SubscriptionID: cfg.GetString("subscription.id"),
+			ResourceGroup:  cfg.GetString("resource.group"),
+		}}
+	}
+
+	if len(clusters) == 0 {
+		return nil, errors.New("no clusters configured")
+	}
+
+	seen := make(map[string]bool)
+	for i := range clusters {
+		cluster := &clusters[i]
+		if cluster.SubscriptionID == "" {
+			return nil, fmt.Errorf("missing required config: subscription id for cluster %d", i)
+		}
+		if cluster.ResourceGroup == "" {
+			return nil, fmt.Errorf("missing required config: resource group for cluster %d", i)
+		}
+		if cluster.Name == "" {
+			return nil, fmt.Errorf("missing required config: name for cluster %d", i)
+		}
+		if cluster.ConfigMapName == "" {
+			cluster.ConfigMapName = cfg.GetString("configmap.cluster-autoscaler.name")
+		}
+		if cluster.ConfigMapNamespace == "" {
+			cluster.ConfigMapNamespace = cfg.GetString("configmap.cluster-autoscaler.namespace")
+		}
+
+		// Per-cluster state, metrics and API paths are keyed by name, so names
+		// must be unique even across resource groups
+		if seen[cluster.Name] {
+			return nil, fmt.Errorf("cluster %s is configured more than once", cluster.Name)
+		}
+		seen[cluster.Name] = true
+	}
+
+	return clusters, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadClusters(t *testing.T) {
+	cfg := viper.New()
+	cfg.SetDefault("configmap.cluster-autoscaler.name", "cluster-autoscaler-priority-expander")
+	cfg.SetDefault("configmap.cluster-autoscaler.namespace", "kube-system")
+	cfg.Set("subscription.id", "sub")
+	cfg.Set("resource.group", "rg")
+	cfg.Set("cluster.name", "aks")
+
+	clusters, err := loadClusters(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{{
+		Name:               "aks",
+		SubscriptionID:     "sub",
+		ResourceGroup:      "rg",
+		ConfigMapName:      "cluster-autoscaler-priority-expander",
+		ConfigMapNamespace: "kube-system",
+	}}, clusters)
+
+	cfg.Set("clusters", []map[string]interface{}{
+		{"name": "aks-a", "subscriptionId": "sub", "resourceGroup": "rg-a", "context": "aks-a"},
+		{"name": "aks-b", "subscriptionId": "sub", "resourceGroup": "rg-b", "configmapNamespace": "autoscaler"},
+	})
+	clusters, err = loadClusters(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, clusters, 2)
+	assert.Equal(t, "aks-a", clusters[0].Context)
+	assert.Equal(t, "kube-system", clusters[0].ConfigMapNamespace)
+	assert.Equal(t, "autoscaler", clusters[1].ConfigMapNamespace)
+
+	// Names are unique across resource groups
+	cfg.Set("clusters", []map[string]interface{}{
+		{"name": "aks", "subscriptionId": "sub", "resourceGroup": "rg-a"},
+		{"name": "aks", "subscriptionId": "sub", "resourceGroup": "rg-b"},
+	})
+	_, err = loadClusters(cfg)
+	assert.Error(t, err)
+
+	cfg.Set("clusters", []map[string]interface{}{
+		{"name": "aks-a", "subscriptionId": "sub"},
+	})
+	_, err = loadClusters(cfg)
+	assert.Error(t, err)
+}
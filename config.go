@@ -28,14 +28,7 @@ func setupConfig() *viper.Viper {
 	cfg.AutomaticEnv()
 	cfg.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
-	cfg.SetDefault("metrics.addr", "0.0.0.0:8080")
-	cfg.SetDefault("api.url", "https://prices.azure.com/api/retail/prices")
-	cfg.SetDefault("label.region", "topology.kubernetes.io/region")
-	cfg.SetDefault("label.instance", "node.kubernetes.io/instance-type")
-	cfg.SetDefault("label.nodepool", "agentpool")
-	cfg.SetDefault("time.interval", "120") //time interval in seconds
-	cfg.SetDefault("configmap.cluster-autoscaler.name", "cluster-autoscaler-priority-expander")
-	cfg.SetDefault("configmap.cluster-autoscaler.namespace", "kube-system")
+	setDefaults(cfg)
 
 	if isK8s {
 		lg.SetFormatter(&logrus.JSONFormatter{})
@@ -45,13 +38,95 @@ func setupConfig() *viper.Viper {
 		lg.WithError(err).Error("could not read initial config")
 	}
 
+	if err := reloadScorer(cfg); err != nil {
+		lg.WithError(err).Error("invalid scoring config, using default weighted strategy")
+	}
+	if err := reloadPatternTemplate(cfg); err != nil {
+		lg.WithError(err).Errorf("using default pattern template %s", defaultPatternTemplate)
+	}
+	if err := reloadSafetyPolicy(cfg); err != nil {
+		lg.WithError(err).Fatal("invalid safety config")
+	}
+	if err := reloadZoneAggregation(cfg); err != nil {
+		lg.WithError(err).Fatal("invalid placement config")
+	}
+
 	cfg.OnConfigChange(func(_ fsnotify.Event) {
 		if err := cfg.ReadInConfig(); err != nil {
 			lg.WithError(err).Warn("could not reload config")
 		}
+		if err := reloadScorer(cfg); err != nil {
+			lg.WithError(err).Warn("could not reload scoring config, keeping previous strategy")
+		}
+		if err := reloadPatternTemplate(cfg); err != nil {
+			lg.WithError(err).Warn("could not reload pattern template, keeping previous template")
+		}
+		if err := reloadSafetyPolicy(cfg); err != nil {
+			lg.WithError(err).Warn("could not reload safety policy, keeping previous policy")
+		}
+		if err := reloadZoneAggregation(cfg); err != nil {
+			lg.WithError(err).Warn("could not reload placement zone aggregation, keeping previous method")
+		}
 	})
 
 	go cfg.WatchConfig()
 
 	return cfg
 }
+
+// setDefaults sets the default of every config key.
+func setDefaults(cfg *viper.Viper) {
+	cfg.SetDefault("metrics.addr", "0.0.0.0:8080")
+	cfg.SetDefault("azure.auth.method", "managed-identity")
+	cfg.SetDefault("api.url", "https://prices.azure.com/api/retail/prices")
+	cfg.SetDefault("api.cache.ttl", "1h")
+	cfg.SetDefault("pricing.currency", "USD")
+	cfg.SetDefault("pricing.baseline", "consumption") // consumption, reservation-1y/3y or savings-plan-1y/3y
+	cfg.SetDefault("pricing.reservations.enabled", false)
+	cfg.SetDefault("pricing.savingsplans.enabled", false)
+	cfg.SetDefault("pricing.maxprice.margin", 0.1)
+	cfg.SetDefault("pricing.maxprice.penalty", 10)
+	cfg.SetDefault("eviction.cache.ttl", "30m")
+	cfg.SetDefault("eviction.band.value", "upper") // lower, upper or midpoint
+	cfg.SetDefault("eviction.band.open_upper", defaultOpenEvictionBandUpper)
+	cfg.SetDefault("label.region", "topology.kubernetes.io/region")
+	cfg.SetDefault("label.instance", "node.kubernetes.io/instance-type")
+	cfg.SetDefault("label.nodepool", "agentpool")
+	cfg.SetDefault("label.zone", "topology.kubernetes.io/zone")
+	cfg.SetDefault("placement.zone.aggregation", "mean") // min, max, mean or weighted
+	cfg.SetDefault("placement.cache.ttl", "15m")
+	cfg.SetDefault("placement.cache.persist", "") // file or configmap
+	cfg.SetDefault("placement.cache.file", "/var/cache/spot-monitor/placement-scores.json")
+	cfg.SetDefault("placement.cache.configmap.name", "spot-monitor-placement-cache")
+	cfg.SetDefault("placement.cache.configmap.namespace", "kube-system")
+	cfg.SetDefault("history.enabled", false)
+	cfg.SetDefault("history.file", "/var/lib/spot-monitor/history.jsonl")
+	cfg.SetDefault("history.retention", "168h")
+	cfg.SetDefault("time.interval", "120") //time interval in seconds
+	cfg.SetDefault("health.staleness.threshold", "15m")
+	cfg.SetDefault("retry.backoff.base", "10s")
+	cfg.SetDefault("retry.backoff.max", "2m")
+	cfg.SetDefault("configmap.cluster-autoscaler.name", "cluster-autoscaler-priority-expander")
+	cfg.SetDefault("configmap.cluster-autoscaler.namespace", "kube-system")
+	cfg.SetDefault("configmap.mode", "replace")             // replace or merge
+	cfg.SetDefault("configmap.conflict.policy", "preserve") // override, preserve or refuse
+	cfg.SetDefault("pattern.template", defaultPatternTemplate)
+	cfg.SetDefault("scoring.strategy", "weighted")
+	cfg.SetDefault("scoring.trend.window", "6h")
+	cfg.SetDefault("scoring.trend.threshold", 0.5)
+	cfg.SetDefault("scoring.trend.penalty", 0)
+	cfg.SetDefault("regular.placement", "last") // last, threshold or scored
+	cfg.SetDefault("regular.threshold", 30)
+	cfg.SetDefault("smoothing.alpha", 1.0) // 1 disables smoothing
+	cfg.SetDefault("hysteresis.min.delta", 0)
+	cfg.SetDefault("hysteresis.min.dwell", "0s")
+	cfg.SetDefault("dryrun.enabled", false)
+	cfg.SetDefault("safety.policy", "demote") // refuse, demote or alert
+	cfg.SetDefault("events.nodes.enabled", false)
+	cfg.SetDefault("leaderelection.enabled", false)
+	cfg.SetDefault("leaderelection.lease.name", "azure-spot-monitor")
+	cfg.SetDefault("leaderelection.lease.namespace", "kube-system")
+	cfg.SetDefault("leaderelection.lease.duration", "15s")
+	cfg.SetDefault("leaderelection.renew.deadline", "10s")
+	cfg.SetDefault("leaderelection.retry.period", "2s")
+}
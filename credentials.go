@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/spf13/viper"
+)
+
+// newCredential builds the Azure credential shared by every Azure API call,
+// selected by azure.auth.method:
+//   - managed-identity: system or user assigned managed identity (azure.client.id)
+//   - workload-identity: AKS workload identity federation
+//   - client-secret: service principal with azure.client.secret
+//   - client-certificate: service principal with azure.client.certificate.path
+//   - cli: the logged in Azure CLI user, for local runs
+//
+// The azure.* keys can also be provided through the AZURE_* environment
+// variables set by the workload identity webhook or the Azure SDK conventions.
+func newCredential(cfg *viper.Viper) (azcore.TokenCredential, error) {
+	method := cfg.GetString("azure.auth.method")
+	clientID := cfg.GetString("azure.client.id")
+	tenantID := cfg.GetString("azure.tenant.id")
+
+	switch method {
+	case "managed-identity":
+		options := &azidentity.ManagedIdentityCredentialOptions{}
+		// If a client ID is found, configure the options to use the specified user-assigned managed identity.
+		if clientID != "" {
+			options.ID = azidentity.ClientID(clientID)
+		}
+		return azidentity.NewManagedIdentityCredential(options)
+
+	case "workload-identity":
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientID:      clientID,
+			TenantID:      tenantID,
+			TokenFilePath: cfg.GetString("azure.federated.token.file"),
+		})
+
+	case "client-secret":
+		secret := cfg.GetString("azure.client.secret")
+		if tenantID == "" || clientID == "" || secret == "" {
+			return nil, errors.New("client-secret auth requires azure.tenant.id, azure.client.id and azure.client.secret")
+		}
+		return azidentity.NewClientSecretCredential(tenantID, clientID, secret, nil)
+
+	case "client-certificate":
+		certPath := cfg.GetString("azure.client.certificate.path")
+		if tenantID == "" || clientID == "" || certPath == "" {
+			return nil, errors.New("client-certificate auth requires azure.tenant.id, azure.client.id and azure.client.certificate.path")
+		}
+		certData, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		certs, key, err := azidentity.ParseCertificates(certData, []byte(cfg.GetString("azure.client.certificate.password")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		return azidentity.NewClientCertificateCredential(tenantID, clientID, certs, key, nil)
+
+	case "cli":
+		return azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{TenantID: tenantID})
+	}
+
+	return nil, fmt.Errorf("unknown azure.auth.method %q", method)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+type dryRunResult struct {
+	Cluster    string
+	Timestamp  time.Time
+	Priorities string
+	Diff       []string
+}
+
+var lastDryRun = struct {
+	sync.RWMutex
+	results map[string]*dryRunResult
+}{
+	results: make(map[string]*dryRunResult),
+}
+
+// diffPriorities compares the rendered priorities against the ones currently
+// stored in the cluster-autoscaler configmap, one line per changed pattern.
+func diffPriorities(current, rendered string) ([]string, error) {
+	currentPatterns, err := priorityByPattern(current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse current priorities: %w", err)
+	}
+	renderedPatterns, err := priorityByPattern(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered priorities: %w", err)
+	}
+
+	var diff []string
+	for pattern, priority := range renderedPatterns {
+		oldPriority, ok := currentPatterns[pattern]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("+ %s: %d", pattern, priority))
+		} else if oldPriority != priority {
+			diff = append(diff, fmt.Sprintf("~ %s: %d -> %d", pattern, oldPriority, priority))
+		}
+	}
+	for pattern, priority := range currentPatterns {
+		if _, ok := renderedPatterns[pattern]; !ok {
+			diff = append(diff, fmt.Sprintf("- %s: %d", pattern, priority))
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i][2:] < diff[j][2:] })
+
+	return diff, nil
+}
+
+func priorityByPattern(prioritiesYaml string) (map[string]int, error) {
+	priorities := make(map[int][]string)
+	if err := yaml.Unmarshal([]byte(prioritiesYaml), &priorities); err != nil {
+		return nil, err
+	}
+	patterns := make(map[string]int)
+	for priority, entries := range priorities {
+		for _, pattern := range entries {
+			patterns[pattern] = priority
+		}
+	}
+	return patterns, nil
+}
+
+// recordDryRun logs what would have been written to the cluster-autoscaler
+// configmap and keeps it around for the /dryrun endpoint.
+func recordDryRun(cluster, current, rendered string) {
+	diff, err := diffPriorities(current, rendered)
+	if err != nil {
+		lg.WithError(err).Warn("failed to diff priorities")
+		diff = []string{err.Error()}
+	}
+
+	lg.WithFields(logrus.Fields{
+		"cluster":    cluster,
+		"priorities": rendered,
+		"diff":       strings.Join(diff, "\n"),
+	}).Info("Dry-run enabled, not writing autoscaler configmap")
+
+	lastDryRun.Lock()
+	lastDryRun.results[cluster] = &dryRunResult{
+		Cluster:    cluster,
+		Timestamp:  time.Now(),
+		Priorities: rendered,
+		Diff:       diff,
+	}
+	lastDryRun.Unlock()
+}
+
+func dryRunHandler(w http.ResponseWriter, _ *http.Request) {
+	lastDryRun.RLock()
+	results := make([]*dryRunResult, 0, len(lastDryRun.results))
+	for _, result := range lastDryRun.results {
+		results = append(results, result)
+	}
+	lastDryRun.RUnlock()
+
+	if len(results) == 0 {
+		http.Error(w, "no dry-run result available", http.StatusNotFound)
+		return
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Cluster < results[j].Cluster })
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, result := range results {
+		fmt.Fprintf(w, "# cluster %s rendered at %s\n", result.Cluster, result.Timestamp.Format(time.RFC3339))
+		fmt.Fprint(w, result.Priorities)
+		fmt.Fprint(w, "\n# diff against current priorities\n")
+		if len(result.Diff) == 0 {
+			fmt.Fprint(w, "# no changes\n")
+		}
+		for _, line := range result.Diff {
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffPriorities(t *testing.T) {
+	current := "23:\n    - .*general.*\n28:\n    - .*spota.*\n30:\n    - .*spotb.*\n"
+	rendered := "23:\n    - .*general.*\n31:\n    - .*spota.*\n35:\n    - .*spotc.*\n"
+
+	diff, err := diffPriorities(current, rendered)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"~ .*spota.*: 28 -> 31",
+		"- .*spotb.*: 30",
+		"+ .*spotc.*: 35",
+	}, diff)
+
+	diff, err = diffPriorities("", rendered)
+	assert.NoError(t, err)
+	assert.Len(t, diff, 3)
+
+	_, err = diffPriorities("not: [valid", rendered)
+	assert.Error(t, err)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	prioritiesUpdatedReason = "PrioritiesUpdated"
+	eventComponent          = "azure-spot-monitor"
+	// maxEventMessageLength is the longest message the API server accepts
+	maxEventMessageLength = 1024
+)
+
+// priorityChange is a nodepool whose priority changed, with the scoring
+// inputs that changed since the priorities were last written.
+type priorityChange struct {
+	Nodepool string
+	From     int
+	To       int
+	Added    bool
+	Removed  bool
+	Reasons  []string
+}
+
+func (c priorityChange) String() string {
+	var change string
+	switch {
+	case c.Added:
+		change = fmt.Sprintf("%s added at %d", c.Nodepool, c.To)
+	case c.Removed:
+		change = fmt.Sprintf("%s removed from %d", c.Nodepool, c.From)
+	case c.To > c.From:
+		change = fmt.Sprintf("%s up %d→%d", c.Nodepool, c.From, c.To)
+	default:
+		change = fmt.Sprintf("%s down %d→%d", c.Nodepool, c.From, c.To)
+	}
+	if len(c.Reasons) > 0 {
+		change += ": " + strings.Join(c.Reasons, ", ")
+	}
+	return change
+}
+
+func placementLevel(score int) string {
+	switch score {
+	case 25:
+		return "Low"
+	case 50:
+		return "Medium"
+	case 100:
+		return "High"
+	}
+	return fmt.Sprint(score)
+}
+
+// changedInputs lists the scoring inputs of a nodepool that differ from its
+// previous ones, e.g. "placement High→Low".
+func changedInputs(previous, current Nodepool) []string {
+	var reasons []string
+	if previous.PlacementScore != current.PlacementScore {
+		reasons = append(reasons, fmt.Sprintf("placement %s→%s", placementLevel(previous.PlacementScore), placementLevel(current.PlacementScore)))
+	}
+	if previous.Discount != current.Discount {
+		reasons = append(reasons, fmt.Sprintf("discount %.0f%%→%.0f%%", previous.Discount*100, current.Discount*100))
+	}
+	if previous.EvictionRate != current.EvictionRate {
+		reasons = append(reasons, fmt.Sprintf("eviction %.0f%%→%.0f%%", previous.EvictionRate*100, current.EvictionRate*100))
+	}
+	if previous.Version != current.Version {
+		reasons = append(reasons, fmt.Sprintf("version %d→%d", previous.Version, current.Version))
+	}
+	return reasons
+}
+
+// writtenState keeps the nodepools scored for the priorities last written to
+// the configmap of every cluster. Changes are explained against them rather
+// than against the previous reconcile, whose priorities may have been held
+// back and never written.
+type writtenState struct {
+	mu       sync.Mutex
+	clusters map[string]map[string]Nodepool // by cluster and nodepool name
+}
+
+var written = &writtenState{clusters: make(map[string]map[string]Nodepool)}
+
+func (s *writtenState) record(cluster string, nodePools NodepoolMap) {
+	nodepools := make(map[string]Nodepool, len(nodePools))
+	for _, np := range nodePools {
+		nodepools[np.Name] = np
+	}
+	s.mu.Lock()
+	s.clusters[cluster] = nodepools
+	s.mu.Unlock()
+}
+
+// nodepools returns the nodepools last written for a cluster by name.
+func (s *writtenState) nodepools(cluster string) map[string]Nodepool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clusters[cluster]
+}
+
+// priorityChanges compares the priorities in the cluster-autoscaler
+// configmap with the rendered ones and returns the nodepools that moved, were
+// added or removed, sorted by name. previous holds the nodepools scored for
+// the priorities last written.
+func priorityChanges(current, rendered string, previous map[string]Nodepool, nodePools NodepoolMap) ([]priorityChange, error) {
+	currentPatterns, err := priorityByPattern(current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse current priorities: %w", err)
+	}
+	renderedPatterns, err := priorityByPattern(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered priorities: %w", err)
+	}
+
+	var changes []priorityChange
+	for _, np := range nodePools {
+		pattern := nodeGroupPattern(np.Name)
+		to, ok := renderedPatterns[pattern]
+		if !ok {
+			continue
+		}
+		from, existed := currentPatterns[pattern]
+		if existed && from == to {
+			continue
+		}
+
+		change := priorityChange{Nodepool: np.Name, From: from, To: to, Added: !existed}
+		if prev, ok := previous[np.Name]; ok {
+			change.Reasons = changedInputs(prev, np)
+		}
+		changes = append(changes, change)
+	}
+
+	// Removed nodepools are named after the written ones, unknown patterns
+	// after themselves
+	names := make(map[string]string, len(previous))
+	for name := range previous {
+		names[nodeGroupPattern(name)] = name
+	}
+	for pattern, from := range currentPatterns {
+		if _, ok := renderedPatterns[pattern]; ok {
+			continue
+		}
+		name, ok := names[pattern]
+		if !ok {
+			name = pattern
+		}
+		changes = append(changes, priorityChange{Nodepool: name, From: from, Removed: true})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Nodepool < changes[j].Nodepool })
+
+	return changes, nil
+}
+
+func eventMessage(changes []priorityChange) string {
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		lines = append(lines, change.String())
+	}
+	message := strings.Join(lines, "; ")
+	if message == "" {
+		message = "priorities reordered"
+	}
+	if len(message) > maxEventMessageLength {
+		message = strings.ToValidUTF8(message[:maxEventMessageLength-3], "") + "..."
+	}
+	return message
+}
+
+func newPrioritiesEvent(namespace string, object corev1.ObjectReference, message string) *corev1.Event {
+	now := metav1.Now()
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject:      object,
+		Reason:              prioritiesUpdatedReason,
+		Message:             message,
+		Type:                corev1.EventTypeNormal,
+		Source:              corev1.EventSource{Component: eventComponent},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: eventComponent,
+	}
+}
+
+// recordPriorityChanges logs the nodepools that moved between the current
+// and rendered priorities and records them as events.
+func recordPriorityChanges(ctx context.Context, config *viper.Viper, clientset kubernetes.Interface, cm *corev1.ConfigMap, current, rendered string, previous map[string]Nodepool, nodePools NodepoolMap) {
+	changes, err := priorityChanges(current, rendered, previous, nodePools)
+	if err != nil {
+		lg.WithError(err).Warn("failed to compare priorities")
+	}
+	lg.Infof("Priorities changed for configmap %s/%s: %s", cm.Namespace, cm.Name, eventMessage(changes))
+	recordPrioritiesEvents(ctx, config, clientset, cm, changes)
+}
+
+// recordPrioritiesEvents records a PrioritiesUpdated event on the
+// cluster-autoscaler configmap and, with events.nodes.enabled, on every node
+// of the nodepools that moved. Failures are only logged.
+func recordPrioritiesEvents(ctx context.Context, config *viper.Viper, clientset kubernetes.Interface, cm *corev1.ConfigMap, changes []priorityChange) {
+	_, err := clientset.CoreV1().Events(cm.Namespace).Create(ctx, newPrioritiesEvent(cm.Namespace, corev1.ObjectReference{
+		Kind:            "ConfigMap",
+		APIVersion:      "v1",
+		Name:            cm.Name,
+		Namespace:       cm.Namespace,
+		UID:             cm.UID,
+		ResourceVersion: cm.ResourceVersion,
+	}, eventMessage(changes)), metav1.CreateOptions{})
+	if err != nil {
+		lg.WithError(err).Warnf("Failed to record %s event on configmap %s/%s", prioritiesUpdatedReason, cm.Namespace, cm.Name)
+	}
+
+	if !config.GetBool("events.nodes.enabled") {
+		return
+	}
+
+	byNodepool := make(map[string]priorityChange, len(changes))
+	nodepools := make([]string, 0, len(changes))
+	for _, change := range changes {
+		// Removed nodepools have no nodes left to record events on
+		if change.Removed {
+			continue
+		}
+		byNodepool[change.Nodepool] = change
+		nodepools = append(nodepools, change.Nodepool)
+	}
+	if len(nodepools) == 0 {
+		return
+	}
+
+	nodepoolLabel := config.GetString("label.nodepool")
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s in (%s)", nodepoolLabel, strings.Join(nodepools, ",")),
+	})
+	if err != nil {
+		lg.WithError(err).Warnf("Failed to list nodes for %s events", prioritiesUpdatedReason)
+		return
+	}
+
+	for _, node := range nodes.Items {
+		change := byNodepool[node.Labels[nodepoolLabel]]
+		// Events of cluster scoped objects live in the default namespace
+		_, err := clientset.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, newPrioritiesEvent(metav1.NamespaceDefault, corev1.ObjectReference{
+			Kind:       "Node",
+			APIVersion: "v1",
+			Name:       node.Name,
+			UID:        node.UID,
+		}, eventMessage([]priorityChange{change})), metav1.CreateOptions{})
+		if err != nil {
+			lg.WithError(err).Warnf("Failed to record %s event on node %s", prioritiesUpdatedReason, node.Name)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityChanges(t *testing.T) {
+	current := "10:\n  - ^aks-spota-[0-9]+-vmss$\n20:\n  - ^aks-spotb-[0-9]+-vmss$\n  - ^aks-spotc-[0-9]+-vmss$\n40:\n  - ^aks-spote-[0-9]+-vmss$\n"
+	rendered := "10:\n  - ^aks-spotb-[0-9]+-vmss$\n20:\n  - ^aks-spota-[0-9]+-vmss$\n  - ^aks-spotc-[0-9]+-vmss$\n30:\n  - ^aks-spotd-[0-9]+-vmss$\n"
+
+	previous := map[string]Nodepool{
+		"spota": {Name: "spota", PlacementScore: 25, Discount: 0.8, EvictionRate: 0.05},
+		"spotb": {Name: "spotb", PlacementScore: 100, Discount: 0.8, EvictionRate: 0.05},
+		"spote": {Name: "spote", PlacementScore: 100},
+	}
+	nodePools := NodepoolMap{
+		"spota": {Name: "spota", PlacementScore: 100, Discount: 0.8, EvictionRate: 0.05},
+		"spotb": {Name: "spotb", PlacementScore: 25, Discount: 0.6, EvictionRate: 0.05},
+		"spotc": {Name: "spotc", PlacementScore: 50},
+		"spotd": {Name: "spotd", PlacementScore: 50},
+	}
+
+	changes, err := priorityChanges(current, rendered, previous, nodePools)
+	require.NoError(t, err)
+	assert.Equal(t, "spota up 10→20: placement Low→High; spotb down 20→10: placement High→Low, discount 80%→60%; spotd added at 30; spote removed from 40", eventMessage(changes))
+
+	// Nodepools written before a restart are named after their pattern
+	changes, err = priorityChanges(current, rendered, nil, nodePools)
+	require.NoError(t, err)
+	assert.Contains(t, eventMessage(changes), "^aks-spote-[0-9]+-vmss$ removed from 40")
+
+	_, err = priorityChanges("not: [yaml", rendered, previous, nodePools)
+	assert.Error(t, err)
+}
+
+func TestEventMessage(t *testing.T) {
+	assert.Equal(t, "priorities reordered", eventMessage(nil))
+
+	long := eventMessage([]priorityChange{{Nodepool: strings.Repeat("a", 2000), From: 1, To: 2}})
+	assert.Len(t, long, maxEventMessageLength)
+	assert.True(t, strings.HasSuffix(long, "..."))
+}
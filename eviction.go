@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/spf13/viper"
+)
+
+// ResourceGraph is the subset of the Azure Resource Graph client used to
+// query spot eviction rates, *armresourcegraph.Client satisfies it.
+type ResourceGraph interface {
+	Resources(ctx context.Context, query armresourcegraph.QueryRequest, options *armresourcegraph.ClientResourcesOptions) (armresourcegraph.ClientResourcesResponse, error)
+}
+
+type evictionCacheEntry struct {
+	timestamp time.Time
+	rate      string
+}
+
+// EvictionRatesClient looks up spot eviction rates for all SKUs of a region in
+// a single Resource Graph query and caches the results per region and SKU.
+type EvictionRatesClient struct {
+	graph ResourceGraph
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]evictionCacheEntry
+}
+
+func newEvictionRatesClient(cfg *viper.Viper, cred azcore.TokenCredential) (*EvictionRatesClient, error) {
+	clientFactory, err := armresourcegraph.NewClientFactory(cred, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEvictionRatesClientWithGraph(clientFactory.NewClient(), cfg.GetDuration("eviction.cache.ttl")), nil
+}
+
+func newEvictionRatesClientWithGraph(graph ResourceGraph, ttl time.Duration) *EvictionRatesClient {
+	return &EvictionRatesClient{
+		graph: graph,
+		ttl:   ttl,
+		cache: make(map[string]evictionCacheEntry),
+	}
+}
+
+// GetEvictionRates returns the raw eviction rate band (e.g. "0-5" or "20+")
+// for every instance, keyed by instance type. Instances without a published
+// rate map to an empty string.
+func (c *EvictionRatesClient) GetEvictionRates(ctx context.Context, region string, instances []string) (map[string]string, error) {
+	result := make(map[string]string, len(instances))
+	var missing []string
+
+	c.mu.Lock()
+	for _, instance := range instances {
+		entry, ok := c.cache[regionSKUKey(region, instance)]
+		if ok && time.Since(entry.timestamp) < c.ttl {
+			result[instance] = entry.rate
+			continue
+		}
+		missing = append(missing, instance)
+	}
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		lg.Info("returning eviction rates from cache")
+		return result, nil
+	}
+
+	rates, err := c.query(ctx, region, missing)
+	if err != nil {
+		return nil, err
+	}
+	lg.Info("fetching eviction rates was successful")
+
+	now := time.Now()
+	c.mu.Lock()
+	for _, instance := range missing {
+		rate := rates[strings.ToLower(instance)]
+		c.cache[regionSKUKey(region, instance)] = evictionCacheEntry{timestamp: now, rate: rate}
+		result[instance] = rate
+	}
+	c.mu.Unlock()
+
+	return result, nil
+}
+
+// fetchedAt returns when the oldest cached rates of the instances were
+// fetched, or the zero time when any of them is not cached.
+func (c *EvictionRatesClient) fetchedAt(region string, instances []string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest time.Time
+	for _, instance := range instances {
+		entry, ok := c.cache[regionSKUKey(region, instance)]
+		if !ok {
+			return time.Time{}
+		}
+		if oldest.IsZero() || entry.timestamp.Before(oldest) {
+			oldest = entry.timestamp
+		}
+	}
+	return oldest
+}
+
+func (c *EvictionRatesClient) query(ctx context.Context, region string, instances []string) (map[string]string, error) {
+	skus := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		skus = append(skus, fmt.Sprintf("'%s'", strings.ToLower(instance)))
+	}
+
+	query := fmt.Sprintf("spotresources | where type =~ 'microsoft.compute/skuspotevictionrate/location' | where location =~ '%s' | where sku.name in~ (%s) | project skuName = tostring(sku.name), spotEvictionRate = tostring(properties.evictionRate)",
+		region,
+		strings.Join(skus, ", "),
+	)
+
+	rates := make(map[string]string)
+	var skipToken *string
+	for {
+		res, err := c.graph.Resources(ctx, armresourcegraph.QueryRequest{
+			Query: to.Ptr(query),
+			Options: &armresourcegraph.QueryRequestOptions{
+				ResultFormat: to.Ptr(armresourcegraph.ResultFormatObjectArray),
+				SkipToken:    skipToken,
+			},
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		dataSlice, ok := res.Data.([]interface{})
+		if !ok {
+			return nil, errors.New("query response type assertion failed")
+		}
+		for _, row := range dataSlice {
+			dataMap, ok := row.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("query response, failed to assert row as a map[string]interface{}")
+			}
+			skuName, _ := dataMap["skuName"].(string)
+			rate, _ := dataMap["spotEvictionRate"].(string)
+			rates[strings.ToLower(skuName)] = rate
+		}
+
+		if res.SkipToken == nil || *res.SkipToken == "" {
+			break
+		}
+		skipToken = res.SkipToken
+	}
+
+	return rates, nil
+}
+
+// defaultOpenEvictionBandUpper is the upper bound given to the open ended
+// "20+" band, 21% as before eviction bands were parsed.
+const defaultOpenEvictionBandUpper = 0.21
+
+// EvictionBand is a spot eviction rate range as published by Resource Graph,
+// with bounds expressed as fractions. The open ended "20+" band has an upper
+// bound of eviction.band.open_upper.
+type EvictionBand struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// Value returns the representative eviction rate of the band, one of lower,
+// upper or midpoint. Unknown representatives fall back to upper.
+func (b EvictionBand) Value(representative string) float64 {
+	switch representative {
+	case "lower":
+		return b.Lower
+	case "midpoint":
+		return (b.Lower + b.Upper) / 2
+	default:
+		return b.Upper
+	}
+}
+
+// parseEvictionBand parses an eviction rate band (0-5, 5-10, 10-15, 15-20, 20+)
+// given in percent. An empty string means no rate is published and yields a
+// zero band. The open ended band is capped at openUpper, a fraction, or at its
+// lower bound when openUpper is below it.
+func parseEvictionBand(raw string, openUpper float64) (EvictionBand, error) {
+	raw = strings.TrimSpace(strings.ReplaceAll(raw, "%", ""))
+	if raw == "" {
+		return EvictionBand{}, nil
+	}
+
+	if lower, ok := strings.CutSuffix(raw, "+"); ok {
+		l, err := strconv.ParseFloat(strings.TrimSpace(lower), 64)
+		if err != nil {
+			return EvictionBand{}, fmt.Errorf("invalid eviction rate band %q: %w", raw, err)
+		}
+		return EvictionBand{Lower: l / 100, Upper: max(openUpper, l/100)}, nil
+	}
+
+	lower, upper, ok := strings.Cut(raw, "-")
+	if !ok {
+		return EvictionBand{}, fmt.Errorf("invalid eviction rate band %q", raw)
+	}
+	l, err := strconv.ParseFloat(strings.TrimSpace(lower), 64)
+	if err != nil {
+		return EvictionBand{}, fmt.Errorf("invalid eviction rate band %q: %w", raw, err)
+	}
+	u, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil {
+		return EvictionBand{}, fmt.Errorf("invalid eviction rate band %q: %w", raw, err)
+	}
+	if l > u {
+		return EvictionBand{}, fmt.Errorf("invalid eviction rate band %q: lower bound above upper bound", raw)
+	}
+
+	return EvictionBand{Lower: l / 100, Upper: u / 100}, nil
+}
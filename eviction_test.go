@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockResourceGraph struct {
+	queries []string
+	pages   []armresourcegraph.ClientResourcesResponse
+}
+
+func (m *mockResourceGraph) Resources(_ context.Context, query armresourcegraph.QueryRequest, _ *armresourcegraph.ClientResourcesOptions) (armresourcegraph.ClientResourcesResponse, error) {
+	m.queries = append(m.queries, *query.Query)
+	page := m.pages[0]
+	m.pages = m.pages[1:]
+	return page, nil
+}
+
+func TestEvictionRatesClient(t *testing.T) {
+	graph := &mockResourceGraph{
+		pages: []armresourcegraph.ClientResourcesResponse{
+			{QueryResponse: armresourcegraph.QueryResponse{
+				Data: []interface{}{
+					map[string]interface{}{"skuName": "standard_d4s_v5", "spotEvictionRate": "0-5"},
+				},
+				SkipToken: to.Ptr("next"),
+			}},
+			{QueryResponse: armresourcegraph.QueryResponse{
+				Data: []interface{}{
+					map[string]interface{}{"skuName": "standard_e8s_v5", "spotEvictionRate": "20+"},
+				},
+			}},
+		},
+	}
+	client := newEvictionRatesClientWithGraph(graph, time.Hour)
+
+	instances := []string{"Standard_D4s_v5", "Standard_E8s_v5", "Standard_F2s_v2"}
+	rates, err := client.GetEvictionRates(context.Background(), "eastus", instances)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"Standard_D4s_v5": "0-5",
+		"Standard_E8s_v5": "20+",
+		"Standard_F2s_v2": "",
+	}, rates)
+	assert.Len(t, graph.queries, 2)
+	assert.Contains(t, graph.queries[0], "sku.name in~ ('standard_d4s_v5', 'standard_e8s_v5', 'standard_f2s_v2')")
+
+	// A second call within the TTL is served from the cache
+	cached, err := client.GetEvictionRates(context.Background(), "eastus", instances)
+	assert.NoError(t, err)
+	assert.Equal(t, rates, cached)
+	assert.Len(t, graph.queries, 2)
+}
+
+func TestParseEvictionBand(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected EvictionBand
+		wantErr  bool
+	}{
+		{raw: "", expected: EvictionBand{}},
+		{raw: "0-5", expected: EvictionBand{Lower: 0, Upper: 0.05}},
+		{raw: "5-10", expected: EvictionBand{Lower: 0.05, Upper: 0.1}},
+		{raw: "10-15", expected: EvictionBand{Lower: 0.1, Upper: 0.15}},
+		{raw: "15-20", expected: EvictionBand{Lower: 0.15, Upper: 0.2}},
+		{raw: "20+", expected: EvictionBand{Lower: 0.2, Upper: 0.21}},
+		{raw: "10-15%", expected: EvictionBand{Lower: 0.1, Upper: 0.15}},
+		{raw: "high", wantErr: true},
+		{raw: "a-5", wantErr: true},
+		{raw: "10-5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			band, err := parseEvictionBand(tt.raw, defaultOpenEvictionBandUpper)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, tt.expected.Lower, band.Lower, 1e-9)
+			assert.InDelta(t, tt.expected.Upper, band.Upper, 1e-9)
+		})
+	}
+}
+
+// The open ended band keeps the 21% eviction rate it had before bands were
+// parsed, so 20+ SKUs keep their ranking against lower bands.
+func TestOpenEvictionBandRanking(t *testing.T) {
+	open, err := parseEvictionBand("20+", defaultOpenEvictionBandUpper)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.21, open.Value("upper"), 1e-9)
+
+	capped, err := parseEvictionBand("20+", 0.1)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.2, capped.Upper, 1e-9)
+
+	scorer := weightedScorer{weights: scoringPresets["weighted"]}
+	scores := scorer.Score(NodepoolMap{
+		"spota": {Name: "spota", EvictionRate: open.Value("upper"), Discount: 0.5, PlacementScore: 100, Version: 1},
+		"spotb": {Name: "spotb", EvictionRate: 0.15, Discount: 0.9, PlacementScore: 50, Version: 10},
+	})
+	assert.Equal(t, 81, scores["spota"])
+	assert.Greater(t, scores["spota"], scores["spotb"])
+}
+
+func TestEvictionBandValue(t *testing.T) {
+	band := EvictionBand{Lower: 0.1, Upper: 0.15}
+	assert.InDelta(t, 0.1, band.Value("lower"), 1e-9)
+	assert.InDelta(t, 0.15, band.Value("upper"), 1e-9)
+	assert.InDelta(t, 0.125, band.Value("midpoint"), 1e-9)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Data sources whose age is reported by the health endpoints.
+const (
+	sourceNodepools = "nodepools"
+	sourcePrices    = "prices"
+	sourceEviction  = "eviction"
+	sourcePlacement = "placement"
+)
+
+var dataSources = []string{sourceNodepools, sourcePrices, sourceEviction, sourcePlacement}
+
+// reconcileState tracks the outcome of the reconcile loop.
+type reconcileState struct {
+	mu                  sync.RWMutex
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	lastError           string
+	transient           bool
+	consecutiveFailures int
+	configMapUpdates    map[string]time.Time
+	sources             map[string]time.Time
+	// sourceTTLs are the cache TTLs of the sources, data served from a cache
+	// may be that much older than the staleness threshold
+	sourceTTLs map[string]time.Duration
+}
+
+var health = &reconcileState{
+	configMapUpdates: make(map[string]time.Time),
+	sources:          make(map[string]time.Time),
+	sourceTTLs:       make(map[string]time.Duration),
+}
+
+func (s *reconcileState) recordSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSuccess = time.Now()
+	s.consecutiveFailures = 0
+	s.lastError = ""
+	reconcileConsecutiveFailuresMetric.Set(0)
+}
+
+func (s *reconcileState) recordFailure(err error, transient bool, failures int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFailure = time.Now()
+	s.lastError = err.Error()
+	s.transient = transient
+	s.consecutiveFailures = failures
+
+	class := "permanent"
+	if transient {
+		class = "transient"
+	}
+	reconcileErrorsMetric.WithLabelValues(class).Inc()
+	reconcileConsecutiveFailuresMetric.Set(float64(failures))
+}
+
+// recordConfigMapUpdate marks a successful updateConfigMap for a cluster,
+// whether or not the priorities had to change.
+func (s *reconcileState) recordConfigMapUpdate(cluster string) {
+	now := time.Now()
+	s.mu.Lock()
+	s.configMapUpdates[cluster] = now
+	s.mu.Unlock()
+	lastSuccessTimestampMetric.WithLabelValues(cluster).Set(float64(now.Unix()))
+}
+
+// recordSource records when the data of a source was fetched from its API,
+// which is older than the reconcile when it was served from a cache.
+func (s *reconcileState) recordSource(source string, fetchedAt time.Time) {
+	if fetchedAt.IsZero() {
+		return
+	}
+	s.mu.Lock()
+	s.sources[source] = fetchedAt
+	s.mu.Unlock()
+}
+
+func (s *reconcileState) setSourceTTL(source string, ttl time.Duration) {
+	s.mu.Lock()
+	s.sourceTTLs[source] = ttl
+	s.mu.Unlock()
+}
+
+type sourceStatus struct {
+	LastUpdate *time.Time `json:"lastUpdate"`
+	AgeSeconds *float64   `json:"ageSeconds"`
+}
+
+type healthStatus struct {
+	Status              string                  `json:"status"`
+	Problems            []string                `json:"problems,omitempty"`
+	StalenessThreshold  string                  `json:"stalenessThreshold"`
+	LastReconcile       *time.Time              `json:"lastReconcile"`
+	ConsecutiveFailures int                     `json:"consecutiveFailures"`
+	LastError           string                  `json:"lastError,omitempty"`
+	Leader              bool                    `json:"leader"`
+	DryRun              bool                    `json:"dryRun"`
+	LastConfigMapUpdate map[string]*time.Time   `json:"lastConfigMapUpdate"`
+	DataSources         map[string]sourceStatus `json:"dataSources"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// status reports the reconcile state. It is not ready when a cluster has not
+// had its configmap updated within the staleness threshold, or the data of a
+// source was fetched longer than its cache TTL plus the staleness threshold
+// ago. Configmaps are only checked on the leader outside of dry-run, and
+// placement scores on followers once the leader shared them.
+func (s *reconcileState) status(clusters []ClusterConfig, threshold time.Duration, dryRun bool) healthStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	status := healthStatus{
+		Status:              "ok",
+		StalenessThreshold:  threshold.String(),
+		LastReconcile:       timePtr(s.lastSuccess),
+		ConsecutiveFailures: s.consecutiveFailures,
+		LastError:           s.lastError,
+		Leader:              leadership.isLeader(),
+		DryRun:              dryRun,
+		LastConfigMapUpdate: make(map[string]*time.Time),
+		DataSources:         make(map[string]sourceStatus),
+	}
+
+	for _, cluster := range clusters {
+		// Only the leader writes configmaps, and never in dry-run
+		if !status.Leader || dryRun {
+			break
+		}
+		updated := s.configMapUpdates[cluster.Name]
+		status.LastConfigMapUpdate[cluster.Name] = timePtr(updated)
+		if updated.IsZero() {
+			status.Problems = append(status.Problems, fmt.Sprintf("configmap of cluster %s was never updated", cluster.Name))
+		} else if now.Sub(updated) > threshold {
+			status.Problems = append(status.Problems, fmt.Sprintf("configmap of cluster %s was last updated %s ago", cluster.Name, now.Sub(updated).Round(time.Second)))
+		}
+	}
+
+	for _, source := range dataSources {
+		updated := s.sources[source]
+		// Followers have no placement scores until the leader first shares them
+		if updated.IsZero() && source == sourcePlacement && !status.Leader {
+			status.DataSources[source] = sourceStatus{}
+			continue
+		}
+		if updated.IsZero() {
+			status.DataSources[source] = sourceStatus{}
+			status.Problems = append(status.Problems, fmt.Sprintf("%s data was never fetched", source))
+			continue
+		}
+		age := now.Sub(updated)
+		ageSeconds := age.Seconds()
+		status.DataSources[source] = sourceStatus{LastUpdate: timePtr(updated), AgeSeconds: &ageSeconds}
+		if age > threshold+s.sourceTTLs[source] {
+			status.Problems = append(status.Problems, fmt.Sprintf("%s data is %s old", source, age.Round(time.Second)))
+		}
+	}
+
+	if len(status.Problems) > 0 {
+		status.Status = "stale"
+	}
+
+	return status
+}
+
+func writeHealthStatus(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		lg.WithError(err).Error("failed to write health status")
+	}
+}
+
+// healthzHandler reports the reconcile state and always succeeds while the
+// process is able to serve requests.
+func healthzHandler(cfg *viper.Viper, clusters []ClusterConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeHealthStatus(w, http.StatusOK, health.status(clusters, cfg.GetDuration("health.staleness.threshold"), cfg.GetBool("dryrun.enabled")))
+	}
+}
+
+// readyzHandler fails when the priorities or any data source are stale.
+func readyzHandler(cfg *viper.Viper, clusters []ClusterConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		status := health.status(clusters, cfg.GetDuration("health.staleness.threshold"), cfg.GetBool("dryrun.enabled"))
+		code := http.StatusOK
+		if status.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealthStatus(w, code, status)
+	}
+}
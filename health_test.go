@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileStateStatus(t *testing.T) {
+	state := &reconcileState{
+		configMapUpdates: make(map[string]time.Time),
+		sources:          make(map[string]time.Time),
+	}
+	clusters := []ClusterConfig{{Name: "aks-a"}}
+
+	status := state.status(clusters, time.Minute, false)
+	assert.Equal(t, "stale", status.Status)
+	assert.Len(t, status.Problems, 5)
+
+	state.recordConfigMapUpdate("aks-a")
+	for _, source := range dataSources {
+		state.recordSource(source, time.Now())
+	}
+	status = state.status(clusters, time.Minute, false)
+	assert.Equal(t, "ok", status.Status)
+	assert.Empty(t, status.Problems)
+	assert.NotNil(t, status.LastConfigMapUpdate["aks-a"])
+
+	// Cached data is as old as its fetch
+	state.recordSource(sourcePlacement, time.Now().Add(-2*time.Minute))
+	status = state.status(clusters, time.Minute, false)
+	assert.Equal(t, "stale", status.Status)
+	assert.Len(t, status.Problems, 1)
+
+	// A dry-run never updates configmaps, they are not checked
+	state.recordSource(sourcePlacement, time.Now())
+	state.configMapUpdates = make(map[string]time.Time)
+	status = state.status(clusters, time.Minute, true)
+	assert.Equal(t, "ok", status.Status)
+	assert.True(t, status.DryRun)
+}
+
+func TestReadyzHandler(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("health.staleness.threshold", "1m")
+	clusters := []ClusterConfig{{Name: "never-updated"}}
+
+	rec := httptest.NewRecorder()
+	readyzHandler(cfg, clusters)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = httptest.NewRecorder()
+	healthzHandler(cfg, clusters)(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"stale"`)
+}
+
+func TestReconcileStateSourceTTL(t *testing.T) {
+	state := &reconcileState{
+		configMapUpdates: make(map[string]time.Time),
+		sources:          make(map[string]time.Time),
+		sourceTTLs:       make(map[string]time.Duration),
+	}
+	state.recordConfigMapUpdate("aks-a")
+	for _, source := range dataSources {
+		state.recordSource(source, time.Now())
+	}
+	state.setSourceTTL(sourcePrices, time.Hour)
+
+	// Prices served from a 1h cache are not stale yet, until the cache should
+	// have been refreshed
+	state.recordSource(sourcePrices, time.Now().Add(-30*time.Minute))
+	assert.Equal(t, "ok", state.status([]ClusterConfig{{Name: "aks-a"}}, time.Minute, false).Status)
+
+	state.recordSource(sourcePrices, time.Now().Add(-62*time.Minute))
+	assert.Equal(t, "stale", state.status([]ClusterConfig{{Name: "aks-a"}}, time.Minute, false).Status)
+}
+
+func TestFollowerStatus(t *testing.T) {
+	leadership.enabled.Store(true)
+	defer leadership.enabled.Store(false)
+
+	state := &reconcileState{
+		configMapUpdates: make(map[string]time.Time),
+		sources:          make(map[string]time.Time),
+	}
+	for _, source := range []string{sourceNodepools, sourcePrices, sourceEviction} {
+		state.recordSource(source, time.Now())
+	}
+
+	// Neither configmaps nor placement scores are expected before the leader
+	// shared them
+	status := state.status([]ClusterConfig{{Name: "aks-a"}}, time.Minute, false)
+	assert.Equal(t, "ok", status.Status)
+
+	state.recordSource(sourcePlacement, time.Now().Add(-2*time.Minute))
+	status = state.status([]ClusterConfig{{Name: "aks-a"}}, time.Minute, false)
+	assert.Equal(t, "stale", status.Status)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// historyCompactInterval bounds how often expired samples are dropped from
+// the history file.
+const historyCompactInterval = time.Hour
+
+// HistoryKey identifies a series: an instance type and OS for SKU samples, an
+// instance type and zone of a subscription for placement samples.
+type HistoryKey struct {
+	Subscription string `json:"subscription,omitempty"`
+	Region       string `json:"region"`
+	Instance     string `json:"instance"`
+	OS           string `json:"os,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+}
+
+// HistoryPoint holds the signals of a single reconcile. SKU samples carry the
+// prices and eviction band, zone samples the placement score.
+type HistoryPoint struct {
+	Timestamp       time.Time `json:"timestamp"`
+	SpotPrice       float64   `json:"spotPrice,omitempty"`
+	RegularPrice    float64   `json:"regularPrice,omitempty"`
+	EvictionRateMin float64   `json:"evictionRateMin,omitempty"`
+	EvictionRateMax float64   `json:"evictionRateMax,omitempty"`
+	PlacementScore  int       `json:"placementScore,omitempty"`
+}
+
+// HistorySample is a line of the history file.
+type HistorySample struct {
+	HistoryKey
+	HistoryPoint
+}
+
+type HistorySeries struct {
+	HistoryKey
+	Samples []HistoryPoint `json:"samples"`
+}
+
+// HistoryStore keeps the spot signals of every reconcile for history.retention
+// in memory and in a JSON lines file, so the history survives restarts. New
+// samples are appended, the file is rewritten when expired samples are
+// dropped. A series only takes samples newer than its last one, so that data
+// served from a cache is recorded once, at the time it was fetched.
+type HistoryStore struct {
+	mu          sync.RWMutex
+	path        string
+	retention   time.Duration
+	samples     []HistorySample // oldest first
+	lastSampled map[HistoryKey]time.Time
+	compactedAt time.Time
+}
+
+var history *HistoryStore
+
+// setupHistory enables the history store when history.enabled is set. It
+// exits when the history file cannot be written.
+func setupHistory(cfg *viper.Viper) {
+	if !cfg.GetBool("history.enabled") {
+		return
+	}
+	store, err := newHistoryStore(cfg.GetString("history.file"), cfg.GetDuration("history.retention"))
+	if store == nil {
+		lg.WithError(err).Fatal("Failed to open the spot signal history file")
+	}
+	if err != nil {
+		lg.WithError(err).Warn("failed to load spot signal history, starting empty")
+	}
+	history = store
+}
+
+// newHistoryStore loads the samples of the history file, creating it and its
+// directory when missing. It returns a nil store when the file cannot be
+// opened for writing, and the store with an error when it cannot be read.
+func newHistoryStore(path string, retention time.Duration) (*HistoryStore, error) {
+	h := &HistoryStore{path: path, retention: retention, lastSampled: make(map[HistoryKey]time.Time)}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	skipped := 0
+	for scanner.Scan() {
+		var sample HistorySample
+		// A crash while appending can leave a truncated last line
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			skipped++
+			continue
+		}
+		h.samples = append(h.samples, sample)
+		if sample.Timestamp.After(h.lastSampled[sample.HistoryKey]) {
+			h.lastSampled[sample.HistoryKey] = sample.Timestamp
+		}
+	}
+	if skipped > 0 {
+		lg.Warnf("skipped %d invalid lines of history file %s", skipped, path)
+	}
+	sort.SliceStable(h.samples, func(i, j int) bool { return h.samples[i].Timestamp.Before(h.samples[j].Timestamp) })
+
+	return h, scanner.Err()
+}
+
+// Record appends the samples of a reconcile. The store is left unchanged when
+// it is nil, i.e. history is disabled.
+func (h *HistoryStore) Record(samples []HistorySample, now time.Time) error {
+	if h == nil || len(samples) == 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	samples = slices.Clone(samples)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+	fresh := samples[:0]
+	for _, sample := range samples {
+		if sample.Timestamp.After(h.lastSampled[sample.HistoryKey]) {
+			h.lastSampled[sample.HistoryKey] = sample.Timestamp
+			fresh = append(fresh, sample)
+		}
+	}
+	samples = fresh
+	if len(samples) == 0 {
+		return nil
+	}
+	ordered := len(h.samples) == 0 || !samples[0].Timestamp.Before(h.samples[len(h.samples)-1].Timestamp)
+	h.samples = append(h.samples, samples...)
+	if !ordered {
+		sort.SliceStable(h.samples, func(i, j int) bool { return h.samples[i].Timestamp.Before(h.samples[j].Timestamp) })
+	}
+
+	cutoff := now.Add(-h.retention)
+	if len(h.samples) > 0 && h.samples[0].Timestamp.Before(cutoff) && now.Sub(h.compactedAt) >= historyCompactInterval {
+		first := sort.Search(len(h.samples), func(i int) bool { return !h.samples[i].Timestamp.Before(cutoff) })
+		h.samples = append([]HistorySample(nil), h.samples[first:]...)
+		// Series whose samples all expired are forgotten
+		maps.DeleteFunc(h.lastSampled, func(_ HistoryKey, last time.Time) bool { return last.Before(cutoff) })
+		h.compactedAt = now
+		return h.write(h.samples, false)
+	}
+	return h.write(samples, true)
+}
+
+func (h *HistoryStore) write(samples []HistorySample, appendOnly bool) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, sample := range samples {
+		if err := enc.Encode(sample); err != nil {
+			return err
+		}
+	}
+	if !appendOnly {
+		return writeFileAtomic(h.path, buf.Bytes())
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns the series matching key since the given time, sorted by key.
+// Empty key fields match any value, except that zone series are only returned
+// when zones is set and SKU series only when it is not.
+func (h *HistoryStore) Query(key HistoryKey, zones bool, since time.Time) []HistorySeries {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	series := make(map[HistoryKey][]HistoryPoint)
+	first := sort.Search(len(h.samples), func(i int) bool { return !h.samples[i].Timestamp.Before(since) })
+	for _, sample := range h.samples[first:] {
+		if (sample.Zone != "") != zones || !key.matches(sample.HistoryKey) {
+			continue
+		}
+		series[sample.HistoryKey] = append(series[sample.HistoryKey], sample.HistoryPoint)
+	}
+
+	result := make([]HistorySeries, 0, len(series))
+	for k, points := range series {
+		result = append(result, HistorySeries{HistoryKey: k, Samples: points})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].HistoryKey, result[j].HistoryKey
+		if a.Subscription != b.Subscription {
+			return a.Subscription < b.Subscription
+		}
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		if a.OS != b.OS {
+			return a.OS < b.OS
+		}
+		return a.Zone < b.Zone
+	})
+	return result
+}
+
+func (k HistoryKey) matches(other HistoryKey) bool {
+	return (k.Subscription == "" || k.Subscription == other.Subscription) &&
+		(k.Region == "" || k.Region == other.Region) &&
+		(k.Instance == "" || k.Instance == other.Instance) &&
+		(k.OS == "" || k.OS == other.OS) &&
+		(k.Zone == "" || k.Zone == other.Zone)
+}
+
+// lowPlacementRatio returns the share of placement samples of an instance
+// since the given time that were Low, each sample being a fetch of the scores,
+// over the given zones or all zones when none are given. ok is false without
+// any sample.
+func (h *HistoryStore) lowPlacementRatio(subscription, region, instance string, zones []string, since time.Time) (ratio float64, ok bool) {
+	total, low := 0, 0
+	for _, series := range h.Query(HistoryKey{Subscription: subscription, Region: region, Instance: instance}, true, since) {
+		if len(zones) > 0 && !slices.Contains(zones, series.Zone) {
+			continue
+		}
+		for _, point := range series.Samples {
+			total++
+			if placementLevel(point.PlacementScore) == "Low" {
+				low++
+			}
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(low) / float64(total), true
+}
+
+// applyPlacementTrends sets the Low placement ratio of every spot nodepool
+// over the zones it is scored on.
+func (h *HistoryStore) applyPlacementTrends(subscription, region string, nodePools NodepoolMap, window time.Duration, now time.Time) {
+	if h == nil || window <= 0 {
+		return
+	}
+	for key, np := range nodePools {
+		if np.Type != "Spot" {
+			continue
+		}
+		zones := make([]string, 0, len(np.ZonePlacementScores))
+		for zone := range np.ZonePlacementScores {
+			zones = append(zones, zone)
+		}
+		if ratio, ok := h.lowPlacementRatio(subscription, region, np.Instance, zones, now.Add(-window)); ok {
+			np.LowPlacementRatio = &ratio
+			nodePools[key] = np
+		}
+	}
+}
+
+// historyHandler serves the SKU series (prices and eviction bands), or the
+// zone series (placement scores) with ?series=zones, filtered with
+// ?subscription=, ?region=, ?instance=, ?os= and ?zone=. ?since= is a
+// duration and defaults to the whole retention.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	since := time.Time{}
+	if raw := query.Get("since"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q: %s", raw, err), http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+
+	var zones bool
+	switch query.Get("series") {
+	case "", "skus":
+	case "zones":
+		zones = true
+	default:
+		http.Error(w, fmt.Sprintf("unknown series %q, expected skus or zones", query.Get("series")), http.StatusBadRequest)
+		return
+	}
+
+	key := HistoryKey{
+		Subscription: query.Get("subscription"),
+		Region:       query.Get("region"),
+		Instance:     query.Get("instance"),
+		OS:           query.Get("os"),
+		Zone:         query.Get("zone"),
+	}
+	writeJSON(w, struct {
+		Series []HistorySeries `json:"series"`
+	}{history.Query(key, zones, since)})
+}
+
+// trendScorer demotes spot nodepools whose placement score was Low in at
+// least scoring.trend.threshold of the samples in scoring.trend.window by
+// scoring.trend.penalty points, scaled to the wrapped Scorer.
+type trendScorer struct {
+	Scorer
+	threshold float64
+	penalty   int
+}
+
+func (s trendScorer) Score(nodePools NodepoolMap) map[string]int {
+	scores := s.Scorer.Score(nodePools)
+	if s.penalty == 0 {
+		return scores
+	}
+	for key := range scores {
+		np := nodePools[key]
+		if np.Type == "Spot" && np.LowPlacementRatio != nil && *np.LowPlacementRatio >= s.threshold {
+			scores[key] -= s.penalty
+		}
+	}
+	return keepPositive(scores)
+}
+
+func (s trendScorer) scalePenalty(points int) int {
+	return scaledPenalty(s.Scorer, points)
+}
+
+func newTrendScorer(cfg *viper.Viper, scorer Scorer) Scorer {
+	return trendScorer{
+		Scorer:    scorer,
+		threshold: cfg.GetFloat64("scoring.trend.threshold"),
+		penalty:   scaledPenalty(scorer, cfg.GetInt("scoring.trend.penalty")),
+	}
+}
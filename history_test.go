@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func placementSample(zone string, score int, at time.Time) HistorySample {
+	return HistorySample{
+		HistoryKey:   HistoryKey{Subscription: "sub-a", Region: "eastus", Instance: "Standard_D4s_v5", Zone: zone},
+		HistoryPoint: HistoryPoint{Timestamp: at, PlacementScore: score},
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	h, err := newHistoryStore(path, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Record([]HistorySample{
+		{
+			HistoryKey:   HistoryKey{Region: "eastus", Instance: "Standard_D4s_v5", OS: osLinux},
+			HistoryPoint: HistoryPoint{Timestamp: now.Add(-time.Hour), SpotPrice: 0.04, RegularPrice: 0.2, EvictionRateMin: 0.05, EvictionRateMax: 0.1},
+		},
+		placementSample("1", 100, now.Add(-time.Hour)),
+		placementSample("2", 25, now.Add(-time.Hour)),
+	}, now.Add(-time.Hour)))
+	assert.NoError(t, h.Record([]HistorySample{placementSample("1", 50, now)}, now))
+
+	// Appended samples survive a restart, a truncated last line is skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"region":"eastus","instance":`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	h, err = newHistoryStore(path, 24*time.Hour)
+	assert.NoError(t, err)
+
+	skus := h.Query(HistoryKey{Region: "eastus"}, false, time.Time{})
+	assert.Len(t, skus, 1)
+	assert.Equal(t, 0.04, skus[0].Samples[0].SpotPrice)
+
+	zones := h.Query(HistoryKey{Instance: "Standard_D4s_v5", Zone: "1"}, true, time.Time{})
+	assert.Len(t, zones, 1)
+	assert.Equal(t, []HistoryPoint{{Timestamp: now.Add(-time.Hour), PlacementScore: 100}, {Timestamp: now, PlacementScore: 50}}, zones[0].Samples)
+
+	assert.Len(t, h.Query(HistoryKey{}, true, now.Add(-time.Minute)), 1)
+
+	// Cached scores recorded again are skipped, also after a restart
+	assert.NoError(t, h.Record([]HistorySample{placementSample("1", 50, now)}, now.Add(time.Minute)))
+	assert.Len(t, h.Query(HistoryKey{Zone: "1"}, true, time.Time{})[0].Samples, 2)
+
+	// Expired samples are dropped from memory and from the file
+	later := now.Add(24*time.Hour + 30*time.Minute)
+	assert.NoError(t, h.Record([]HistorySample{placementSample("1", 25, later)}, later))
+	// So are the last sample times of the series that expired
+	assert.Equal(t, map[HistoryKey]time.Time{placementSample("1", 25, later).HistoryKey: later}, h.lastSampled)
+	h, err = newHistoryStore(path, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, h.samples, 1)
+}
+
+func TestHistoryStoreFile(t *testing.T) {
+	// The directory of the history file is created
+	dir := filepath.Join(t.TempDir(), "spot-monitor")
+	h, err := newHistoryStore(filepath.Join(dir, "history.jsonl"), time.Hour)
+	assert.NoError(t, err)
+	assert.NotNil(t, h)
+	assert.FileExists(t, filepath.Join(dir, "history.jsonl"))
+
+	// A file that cannot be written is refused
+	h, err = newHistoryStore(filepath.Join(dir, "history.jsonl", "history.jsonl"), time.Hour)
+	assert.Error(t, err)
+	assert.Nil(t, h)
+}
+
+func TestPlacementTrends(t *testing.T) {
+	h, err := newHistoryStore(filepath.Join(t.TempDir(), "history.jsonl"), 24*time.Hour)
+	assert.NoError(t, err)
+	now := time.Now()
+
+	var samples []HistorySample
+	for i := 0; i < 6; i++ {
+		score := 100
+		if i < 4 {
+			score = 25
+		}
+		samples = append(samples, placementSample("1", score, now.Add(-time.Duration(i)*time.Hour)), placementSample("2", 100, now.Add(-time.Duration(i)*time.Hour)))
+	}
+	samples = append(samples, placementSample("1", 25, now.Add(-10*time.Hour)))
+	assert.NoError(t, h.Record(samples, now))
+
+	nodePools := NodepoolMap{
+		"spota":   {Name: "spota", Instance: "Standard_D4s_v5", Type: "Spot", ZonePlacementScores: map[string]int{"1": 100}},
+		"spotb":   {Name: "spotb", Instance: "Standard_D4s_v5", Type: "Spot"},
+		"general": {Name: "general", Instance: "Standard_D4s_v5", Type: "Regular"},
+	}
+	h.applyPlacementTrends("sub-a", "eastus", nodePools, 6*time.Hour, now)
+
+	// Low 4 of the last 6 hours in zone 1, 4 of 12 samples over every zone
+	assert.InDelta(t, 4.0/6, *nodePools["spota"].LowPlacementRatio, 1e-9)
+	assert.InDelta(t, 4.0/12, *nodePools["spotb"].LowPlacementRatio, 1e-9)
+	assert.Nil(t, nodePools["general"].LowPlacementRatio)
+
+	scorer := trendScorer{Scorer: fixedScorer{"spota": 50, "spotb": 50, "general": 20}, threshold: 0.5, penalty: 15}
+	assert.Equal(t, map[string]int{"spota": 35, "spotb": 50, "general": 20}, scorer.Score(nodePools))
+
+	// Lexicographic ranks lose one rank and stay positive
+	cfg := viper.New()
+	cfg.Set("scoring.trend.threshold", 0.5)
+	cfg.Set("scoring.trend.penalty", 15)
+	ranked := newTrendScorer(cfg, lexicographicScorer{order: []string{"version"}})
+	assert.Equal(t, map[string]int{"spota": 1, "spotb": 2, "general": 2}, ranked.Score(nodePools))
+}
+
+func TestHistoryHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	historyHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	h, err := newHistoryStore(filepath.Join(t.TempDir(), "history.jsonl"), 24*time.Hour)
+	assert.NoError(t, err)
+	now := time.Now()
+	assert.NoError(t, h.Record([]HistorySample{placementSample("1", 50, now), placementSample("2", 25, now)}, now))
+	history = h
+	defer func() { history = nil }()
+
+	rec = httptest.NewRecorder()
+	historyHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history?series=zones&zone=2&since=1h", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Series []HistorySeries `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Len(t, body.Series, 1)
+	assert.Equal(t, "2", body.Series[0].Zone)
+	assert.Equal(t, 25, body.Series[0].Samples[0].PlacementScore)
+
+	rec = httptest.NewRecorder()
+	historyHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
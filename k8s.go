@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
@@ -33,8 +36,7 @@ func getK8SClient() (clientset *kubernetes.Clientset, err error) {
 		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	}
 	if err != nil {
-		lg.WithError(err).Fatal("failed to build config")
-		return nil, err
+		return nil, fmt.Errorf("failed to build config: %w", err)
 	}
 	client, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
@@ -44,67 +46,239 @@ func getK8SClient() (clientset *kubernetes.Clientset, err error) {
 	return client, nil
 }
 
+// getK8SClientFor builds a clientset for an explicit kubeconfig and/or
+// context, falling back to getK8SClient when neither is set.
+func getK8SClientFor(kubeconfig, kubeContext string) (clientset *kubernetes.Clientset, err error) {
+	if kubeconfig == "" && kubeContext == "" {
+		return getK8SClient()
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build config for context %q: %w", kubeContext, err)
+	}
+
+	return kubernetes.NewForConfig(cfg)
+}
+
+// bestSpotPriority returns the highest priority assigned to any Spot nodepool,
+// ok is false when there are no Spot nodepools.
+func bestSpotPriority(nodePools NodepoolMap, priorities map[int][]string) (best int, ok bool) {
+	spotPatterns := make(map[string]bool)
+	for _, np := range nodePools {
+		if np.Type == "Spot" {
+			spotPatterns[nodeGroupPattern(np.Name)] = true
+		}
+	}
+
+	for priority, patterns := range priorities {
+		for _, pattern := range patterns {
+			if spotPatterns[pattern] && (!ok || priority > best) {
+				best, ok = priority, true
+			}
+		}
+	}
+	return best, ok
+}
+
+// checkSpotIsSafe reports whether every Regular nodepool is ranked strictly
+// below the best Spot nodepool.
 func checkSpotIsSafe(nodePools NodepoolMap, priorities map[int][]string) bool {
+	best, ok := bestSpotPriority(nodePools, priorities)
+	if !ok {
+		return true
+	}
 
 	// Get default nodepool names
-	regularNodepoolNames := []string{}
+	regularNodepoolNames := make(map[string]bool)
 	for _, np := range nodePools {
 		if np.Type == "Regular" {
-			regularNodepoolNames = append(regularNodepoolNames, fmt.Sprintf(".*%s.*", strings.TrimSpace(np.Name)))
+			regularNodepoolNames[nodeGroupPattern(np.Name)] = true
 		}
 	}
 
-	// Find the highest priority value
-	var maxPriority int
-	for priority := range priorities {
-		if priority > maxPriority {
-			maxPriority = priority
+	for priority, patterns := range priorities {
+		if priority < best {
+			continue
+		}
+		for _, pattern := range patterns {
+			if regularNodepoolNames[pattern] {
+				return false
+			}
 		}
 	}
 
-	// Get the nodepool patterns at the highest priority
-	highestPriorityPools := priorities[maxPriority]
+	return true
+}
 
-	// Check if any of them match a default nodepool name
-	for _, pattern := range highestPriorityPools {
-		for _, defaultName := range regularNodepoolNames {
-			if pattern == defaultName {
-				return false
+var activeSafetyPolicy = struct {
+	sync.RWMutex
+	policy string
+}{
+	policy: "demote",
+}
+
+// reloadSafetyPolicy swaps in safety.policy from the current config. On error
+// the previous policy is kept.
+func reloadSafetyPolicy(cfg *viper.Viper) error {
+	policy := cfg.GetString("safety.policy")
+	switch policy {
+	case "refuse", "demote", "alert":
+	default:
+		return fmt.Errorf("unknown safety.policy %q, expected refuse, demote or alert", policy)
+	}
+	activeSafetyPolicy.Lock()
+	activeSafetyPolicy.policy = policy
+	activeSafetyPolicy.Unlock()
+	return nil
+}
+
+func currentSafetyPolicy() string {
+	activeSafetyPolicy.RLock()
+	defer activeSafetyPolicy.RUnlock()
+	return activeSafetyPolicy.policy
+}
+
+// enforceSpotSafety applies the configured safety.policy when a Regular
+// nodepool ties or beats every Spot nodepool:
+//   - refuse: return an error so the configmap is left untouched
+//   - demote: move offending Regular nodepools just below the best Spot nodepool
+//   - alert: log a warning and keep the priorities as they are
+func enforceSpotSafety(policy string, nodePools NodepoolMap, priorities map[int][]string) (map[int][]string, error) {
+	if checkSpotIsSafe(nodePools, priorities) {
+		spotSafetyDecisionMetric.WithLabelValues(policy, "safe").Inc()
+		return priorities, nil
+	}
+
+	switch policy {
+	case "refuse":
+		spotSafetyDecisionMetric.WithLabelValues(policy, "refused").Inc()
+		return nil, errors.New("refusing to write priorities, a regular nodepool ranks at or above every spot nodepool")
+	case "alert":
+		spotSafetyDecisionMetric.WithLabelValues(policy, "alerted").Inc()
+		lg.Warn("a regular nodepool ranks at or above every spot nodepool")
+		return priorities, nil
+	case "demote":
+	default:
+		return nil, fmt.Errorf("unknown safety.policy %q", policy)
+	}
+
+	best, _ := bestSpotPriority(nodePools, priorities)
+	regularNodepoolNames := make(map[string]bool)
+	for _, np := range nodePools {
+		if np.Type == "Regular" {
+			regularNodepoolNames[nodeGroupPattern(np.Name)] = true
+		}
+	}
+
+	// Free the slot just below the best Spot nodepool when another entry holds
+	// it, so demoted nodepools never tie with lower Spot nodepools
+	shift := 0
+	for _, pattern := range priorities[best-1] {
+		if !regularNodepoolNames[pattern] {
+			shift = 1
+			break
+		}
+	}
+
+	demoted := make(map[int][]string)
+	lowest := best - 1
+	for priority, patterns := range priorities {
+		for _, pattern := range patterns {
+			target := priority
+			switch {
+			case priority >= best && regularNodepoolNames[pattern]:
+				target = best - 1
+				lg.Warnf("demoting regular nodepool %s from priority %d to %d", pattern, priority, target)
+			case priority < best:
+				target = priority - shift
 			}
+			lowest = min(lowest, target)
+			demoted[target] = append(demoted[target], pattern)
 		}
 	}
+	demoted = raisePriorities(demoted, 1-lowest)
+	for _, patterns := range demoted {
+		sort.Strings(patterns)
+	}
+	spotSafetyDecisionMetric.WithLabelValues(policy, "demoted").Inc()
 
-	return true
+	return demoted, nil
+}
+
+// raisePriorities adds by to every priority when it is positive, keeping the
+// cluster-autoscaler priorities at 1 or more.
+func raisePriorities(priorities map[int][]string, by int) map[int][]string {
+	if by <= 0 {
+		return priorities
+	}
+	raised := make(map[int][]string, len(priorities))
+	for priority, patterns := range priorities {
+		raised[priority+by] = patterns
+	}
+	return raised
+}
+
+func calculatePriority(nodePools NodepoolMap, scorer Scorer) (priorities map[int][]string) {
+	return priorityPatterns(nodePools, applyOverrides(nodePools, scorer.Score(nodePools)))
 }
 
-func calculatePriority(nodePools NodepoolMap) (priorities map[int][]string) {
+// priorityPatterns groups the node group patterns of the nodepools by
+// priority.
+func priorityPatterns(nodePools NodepoolMap, priorities map[string]int) map[int][]string {
 	priorityMap := make(map[int][]string)
-	for _, nodePool := range nodePools {
-		var priority int
-		// Calculate the components of the discount and placementscore on the priority with placementscore having more weight
-		availabilityRateFactor := (1 - nodePool.EvictionRate) * 0.2
-		discountFactor := nodePool.Discount * 0.1
-		placementScoreFactor := float64(nodePool.PlacementScore) / 100 * 0.6
-		versionFactor := float64(min(10, nodePool.Version)) / 10 * 0.1
-		priority = int((availabilityRateFactor + discountFactor + versionFactor + placementScoreFactor) * 100)
+	for key, priority := range priorities {
+		priorityMap[priority] = append(priorityMap[priority], nodeGroupPattern(nodePools[key].Name))
+	}
 
-		priorityMap[priority] = append(priorityMap[priority], fmt.Sprintf(".*%s.*", nodePool.Name))
+	// Keep the rendered configmap stable across ticks regardless of map iteration order
+	for _, patterns := range priorityMap {
+		sort.Strings(patterns)
 	}
 
 	return priorityMap
 }
 
-func updateConfigMap(ctx context.Context, config *viper.Viper, nodePools NodepoolMap) error {
+func updateConfigMap(ctx context.Context, config *viper.Viper, cluster ClusterConfig, nodePools NodepoolMap) error {
+
+	stability, err := newStabilityConfig(config)
+	if err != nil {
+		return err
+	}
+	// Only scoring uses the smoothed inputs, the API and events show the
+	// fetched ones. They are computed on a fork and committed with the
+	// applied priorities once those are written.
+	pending := stabilizer.fork(cluster.Name)
+	smoothed := pending.smooth(cluster.Name, nodePools, stability.Alpha)
+	scores := pending.stabilize(cluster.Name, currentScorer().Score(smoothed), stability, time.Now())
+	// Pins and exclusions are applied right away, never held back
+	stablePriorities := priorityPatterns(nodePools, applyOverrides(nodePools, scores))
 
-	calculatedPriorities := calculatePriority(nodePools)
-	clientset, err := getK8SClient()
+	calculatedPriorities, err := enforceSpotSafety(currentSafetyPolicy(), nodePools, stablePriorities)
 	if err != nil {
-		lg.WithError(err).Fatal("failed to create clientset")
 		return err
 	}
+	previous := written.nodepools(cluster.Name)
+	latest.recordPriorities(cluster.Name, nodePools, smoothed, calculatedPriorities)
+
+	// Followers only serve the priorities, the leader writes them
+	if !leadership.isLeader() {
+		stabilizer.commit(cluster.Name, pending)
+		return nil
+	}
 
-	clusterAutoscalerCmName := config.GetString("configmap.cluster-autoscaler.name")
-	clusterAutoscalerCmNamespace := config.GetString("configmap.cluster-autoscaler.namespace")
+	clientset, err := getK8SClientFor(cluster.Kubeconfig, cluster.Context)
+	if err != nil {
+		return fmt.Errorf("failed to create clientset: %w", err)
+	}
+
+	clusterAutoscalerCmName := cluster.ConfigMapName
+	clusterAutoscalerCmNamespace := cluster.ConfigMapNamespace
 
 	//prepare yaml for cluster-autoscaler configmap
 	newData := PriorityData{calculatedPriorities}
@@ -116,6 +290,43 @@ func updateConfigMap(ctx context.Context, config *viper.Viper, nodePools Nodepoo
 
 	// Retrieve the existing cluster-autoscaler ConfigMap
 	cm, err := clientset.CoreV1().ConfigMaps(clusterAutoscalerCmNamespace).Get(ctx, clusterAutoscalerCmName, metav1.GetOptions{})
+
+	// In merge mode only the patterns owned by the monitor are replaced
+	mergeMode := config.GetString("configmap.mode") == "merge"
+	owned := make([]string, 0)
+	if mergeMode {
+		for _, patterns := range calculatedPriorities {
+			owned = append(owned, patterns...)
+		}
+		if err == nil {
+			merged, nowOwned, mergeErr := mergeConfigMapPriorities(cm, nodePools, calculatedPriorities, config.GetString("configmap.conflict.policy"))
+			if mergeErr != nil {
+				return mergeErr
+			}
+			// Preserved foreign entries can still rank a Regular nodepool above
+			// every Spot nodepool, check what is actually written
+			if !checkSpotIsSafe(nodePools, merged) {
+				if merged, mergeErr = enforceMergedSpotSafety(currentSafetyPolicy(), nodePools, merged, nowOwned); mergeErr != nil {
+					return mergeErr
+				}
+			}
+			mergedYaml, mergeErr := yaml.Marshal(merged)
+			if mergeErr != nil {
+				return mergeErr
+			}
+			newDataYamlString, owned = string(mergedYaml), nowOwned
+		}
+	}
+
+	if config.GetBool("dryrun.enabled") {
+		currentDataYamlString := ""
+		if err == nil {
+			currentDataYamlString = cm.Data["priorities"]
+		}
+		recordDryRun(cluster.Name, currentDataYamlString, newDataYamlString)
+		return nil
+	}
+
 	if err != nil {
 		cm := &corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
@@ -126,28 +337,50 @@ func updateConfigMap(ctx context.Context, config *viper.Viper, nodePools Nodepoo
 				"priorities": newDataYamlString,
 			},
 		}
-		_, err = clientset.CoreV1().ConfigMaps(clusterAutoscalerCmNamespace).Create(ctx, cm, metav1.CreateOptions{})
+		if mergeMode {
+			cm.Annotations = map[string]string{ownedPatternsAnnotation: ownedPatternsValue(owned)}
+		}
+		cm, err = clientset.CoreV1().ConfigMaps(clusterAutoscalerCmNamespace).Create(ctx, cm, metav1.CreateOptions{})
 		if err != nil {
 			return err
 		}
-		lg.Info("Autoscaler configmap created")
+		lg.Infof("Autoscaler configmap created for cluster %s", cluster.Name)
+		stabilizer.commit(cluster.Name, pending)
+		written.record(cluster.Name, nodePools)
+		recordPriorityChanges(ctx, config, clientset, cm, "", newDataYamlString, previous, nodePools)
 		return nil
 	}
 
-	if newDataYamlString == cm.Data["priorities"] {
+	ownedValue := ownedPatternsValue(owned)
+	if newDataYamlString == cm.Data["priorities"] && (!mergeMode || cm.Annotations[ownedPatternsAnnotation] == ownedValue) {
 		lg.Info("No need to update, existing data is already up to date")
+		stabilizer.commit(cluster.Name, pending)
+		written.record(cluster.Name, nodePools)
 		return nil
 	}
 
+	currentDataYamlString := cm.Data["priorities"]
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
 	cm.Data["priorities"] = newDataYamlString
+	if mergeMode {
+		if cm.Annotations == nil {
+			cm.Annotations = make(map[string]string)
+		}
+		cm.Annotations[ownedPatternsAnnotation] = ownedValue
+	}
 
 	// Update the cluster-autoscaler ConfigMap
-	_, err = clientset.CoreV1().ConfigMaps(clusterAutoscalerCmNamespace).Update(ctx, cm, metav1.UpdateOptions{})
+	cm, err = clientset.CoreV1().ConfigMaps(clusterAutoscalerCmNamespace).Update(ctx, cm, metav1.UpdateOptions{})
 	if err != nil {
 		return err
 	}
 
-	lg.Info("Autoscaler configmap updated")
+	lg.Infof("Autoscaler configmap updated for cluster %s", cluster.Name)
+	stabilizer.commit(cluster.Name, pending)
+	written.record(cluster.Name, nodePools)
+	recordPriorityChanges(ctx, config, clientset, cm, currentDataYamlString, newDataYamlString, previous, nodePools)
 
 	return nil
 }
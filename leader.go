@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderState tracks whether this replica may fetch placement scores and
+// write the cluster-autoscaler configmap. Without leader election every
+// replica is the leader.
+type leaderState struct {
+	enabled atomic.Bool
+	leader  atomic.Bool
+}
+
+var leadership = &leaderState{}
+
+func (s *leaderState) isLeader() bool {
+	return !s.enabled.Load() || s.leader.Load()
+}
+
+func (s *leaderState) setLeader(leader bool) {
+	if s.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		leaderMetric.Set(1)
+		leadershipTransitionsMetric.WithLabelValues("acquired").Inc()
+	} else {
+		leaderMetric.Set(0)
+		leadershipTransitionsMetric.WithLabelValues("lost").Inc()
+	}
+}
+
+func leaderIdentity() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// runLeaderElection campaigns for the Lease leaderelection.lease.name until
+// ctx is done, calling onStartedLeading every time leadership is acquired.
+// Callers enable leadership before starting it so that no reconcile runs as
+// leader before the first election.
+func runLeaderElection(ctx context.Context, cfg *viper.Viper, onStartedLeading func()) error {
+	clientset, err := getK8SClient()
+	if err != nil {
+		return err
+	}
+	identity, err := leaderIdentity()
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      cfg.GetString("leaderelection.lease.name"),
+			Namespace: cfg.GetString("leaderelection.lease.namespace"),
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.GetDuration("leaderelection.lease.duration"),
+		RenewDeadline:   cfg.GetDuration("leaderelection.renew.deadline"),
+		RetryPeriod:     cfg.GetDuration("leaderelection.retry.period"),
+		ReleaseOnCancel: true,
+		Name:            identity,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				lg.Infof("%s acquired leadership", identity)
+				leadership.setLeader(true)
+				onStartedLeading()
+			},
+			OnStoppedLeading: func() {
+				lg.Warnf("%s lost leadership", identity)
+				leadership.setLeader(false)
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					lg.Infof("%s is the leader", current)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Run returns when leadership is lost, campaign again until shutdown
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
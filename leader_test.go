@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderState(t *testing.T) {
+	state := &leaderState{}
+	assert.True(t, state.isLeader())
+
+	state.enabled.Store(true)
+	assert.False(t, state.isLeader())
+
+	acquired := testutil.ToFloat64(leadershipTransitionsMetric.WithLabelValues("acquired"))
+	lost := testutil.ToFloat64(leadershipTransitionsMetric.WithLabelValues("lost"))
+
+	state.setLeader(true)
+	state.setLeader(true)
+	assert.True(t, state.isLeader())
+	assert.Equal(t, 1.0, testutil.ToFloat64(leaderMetric))
+	assert.Equal(t, acquired+1, testutil.ToFloat64(leadershipTransitionsMetric.WithLabelValues("acquired")))
+
+	state.setLeader(false)
+	assert.False(t, state.isLeader())
+	assert.Equal(t, 0.0, testutil.ToFloat64(leaderMetric))
+	assert.Equal(t, lost+1, testutil.ToFloat64(leadershipTransitionsMetric.WithLabelValues("lost")))
+}
+
+func TestFollowerStatusIgnoresConfigMaps(t *testing.T) {
+	leadership.enabled.Store(true)
+	defer leadership.enabled.Store(false)
+
+	state := &reconcileState{
+		configMapUpdates: make(map[string]time.Time),
+		sources:          make(map[string]time.Time),
+	}
+	for _, source := range dataSources {
+		state.recordSource(source, time.Now())
+	}
+
+	status := state.status([]ClusterConfig{{Name: "aks-a"}}, time.Minute, false)
+	assert.Equal(t, "ok", status.Status)
+	assert.False(t, status.Leader)
+}
@@ -1,92 +1,92 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
-	"os"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice"
-	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
 	"github.com/gopuff/morecontext"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
-type Item struct {
-	CurrencyCode string  `json:"currencyCode"`
-	RetailPrice  float64 `json:"retailPrice"`
-	SKUName      string  `json:"skuName"`
-	ProductName  string  `json:"productName"`
-}
-
-type Response struct {
-	Items []Item `json:"Items"`
-}
-
 type Nodepool struct {
-	Name           string  `json:"name"`
-	Discount       float64 `json:"discount"`
-	EvictionRate   float64 `json:"evictionRate"`
-	PlacementScore int     `json:"placementScore"`
-	Version        int     `json:"version"`
-	Type           string  `json:"type"`
-}
-
-type NodepoolMap map[string]Nodepool
-
-type PlacementScoreCache struct {
-	mu   sync.Mutex
-	data placementCacheEntry
-	ttl  time.Duration
+	Name                string             `json:"name"`
+	Instance            string             `json:"instance"`
+	Price               float64            `json:"price"`
+	Currency            string             `json:"currency"`
+	SpotMaxPrice        float64            `json:"spotMaxPrice,omitempty"`
+	Discount            float64            `json:"discount"`
+	EvictionRate        float64            `json:"evictionRate"`
+	PlacementScore      int                `json:"placementScore"`
+	ZonePlacementScores map[string]int     `json:"zonePlacementScores,omitempty"`
+	Version             int                `json:"version"`
+	Type                string             `json:"type"`
+	OSType              string             `json:"osType"`
+	OSSKU               string             `json:"osSku,omitempty"`
+	LowPlacementRatio   *float64           `json:"lowPlacementRatio,omitempty"`
+	Overrides           *NodepoolOverrides `json:"overrides,omitempty"`
 }
 
-type placementCacheEntry struct {
-	cacheKey  string
-	timestamp time.Time
-	scores    map[string]map[string]int
+// AgentPool is an AKS nodepool as discovered by getNodepools.
+type AgentPool struct {
+	Name         string
+	Zones        []string
+	Priority     string
+	OSType       string
+	OSSKU        string
+	SpotMaxPrice float64
+	Overrides    *NodepoolOverrides
 }
 
-var placementCache = &PlacementScoreCache{
-	data: placementCacheEntry{
-		cacheKey:  "",
-		timestamp: time.Time{},
-		scores:    make(map[string]map[string]int),
-	},
-	ttl: 15 * time.Minute, // minimum TTL per Azure docs
-}
+type NodepoolMap map[string]Nodepool
 
 var (
 	spotDiscountMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azure_spot_monitor_current_discount",
 		Help: "The current effective spot discount from original VM price",
-	}, []string{"region", "instance"})
+	}, []string{"region", "instance", "os"})
 
 	spotPriceMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azure_spot_monitor_spot_price",
 		Help: "The current spot instance price",
-	}, []string{"region", "instance"})
+	}, []string{"region", "instance", "os", "currency"})
 
 	spotRegularPriceMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azure_spot_monitor_regular_price",
 		Help: "The original VM price",
-	}, []string{"region", "instance"})
+	}, []string{"region", "instance", "os", "currency"})
+
+	reservedPriceMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_reserved_price",
+		Help: "The hourly reserved instance price by reservation term",
+	}, []string{"region", "instance", "os", "term", "currency"})
+
+	missingBaselinePriceMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_baseline_price_missing",
+		Help: "Whether the price of the pricing baseline is missing for an instance, which then falls back to the pay-as-you-go price",
+	}, []string{"region", "instance", "os", "baseline"})
+
+	spotMaxPriceHeadroomMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_spot_max_price_headroom",
+		Help: "The spot max price of a nodepool minus the current spot price",
+	}, []string{"cluster", "nodepool", "region", "instance", "currency"})
+
+	suppressedPriorityChangesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azure_spot_monitor_suppressed_priority_changes_total",
+		Help: "The number of priority changes held back by hysteresis by reason",
+	}, []string{"cluster", "reason"})
 
 	spotPlacementScoreMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azure_spot_monitor_placement_score",
@@ -97,356 +97,504 @@ var (
 		Name: "azure_spot_monitor_eviction_rate",
 		Help: "The current spot instance eviciton rate",
 	}, []string{"region", "instance"})
-)
-
-func getPrices(region, instance, baseURL string) (regular, spot float64, err error) {
-	urlQuery := fmt.Sprintf("serviceName eq '%s' and priceType eq '%s' and armSkuName eq '%s' and armRegionName eq '%s'",
-		"Virtual Machines",
-		"Consumption",
-		instance,
-		region,
-	)
 
-	fullURL := fmt.Sprintf("%s?$filter=%s",
-		baseURL,
-		strings.ReplaceAll(url.QueryEscape(urlQuery), "+", "%20"),
-	)
+	spotEvictionRateMinMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_eviction_rate_min",
+		Help: "The lower bound of the current spot instance eviction rate band",
+	}, []string{"region", "instance"})
 
-	resp, err := http.Get(fullURL)
-	if err != nil {
-		return 0, 0, err
-	}
-	lg.Info("fetching spot prices was successful")
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			lg.WithError(err).Error("failed to close response body")
-		}
-	}(resp.Body)
+	spotEvictionRateMaxMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_eviction_rate_max",
+		Help: "The upper bound of the current spot instance eviction rate band",
+	}, []string{"region", "instance"})
 
-	var data Response
-	err = json.NewDecoder(resp.Body).Decode(&data)
-	if err != nil {
-		return 0, 0, err
-	}
+	reconcileErrorsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azure_spot_monitor_reconcile_errors_total",
+		Help: "The number of failed reconcile runs by error class",
+	}, []string{"class"})
 
-	var regularItem, spotItem Item
+	reconcileConsecutiveFailuresMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_reconcile_consecutive_failures",
+		Help: "The number of reconcile runs that failed in a row",
+	})
 
-	for _, item := range data.Items {
-		if strings.Contains(item.ProductName, "Windows") {
-			continue
-		} else if strings.Contains(item.SKUName, "Spot") {
-			spotItem = item
-		} else if strings.Contains(item.SKUName, "Low Priority") {
-			// Skip low priority items
-			continue
-		} else {
-			regularItem = item
-		}
-	}
+	lastSuccessTimestampMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_last_success_timestamp_seconds",
+		Help: "The unix timestamp of the last successful cluster-autoscaler configmap update",
+	}, []string{"cluster"})
 
-	return regularItem.RetailPrice, spotItem.RetailPrice, nil
+	spotSafetyDecisionMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azure_spot_monitor_safety_decisions_total",
+		Help: "The number of spot safety checks by policy and decision",
+	}, []string{"policy", "decision"})
 
-}
+	leaderMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "azure_spot_monitor_leader",
+		Help: "Whether this replica is the leader, always 1 without leader election",
+	})
 
-func getEvictionRates(region, instance string, ctx context.Context) (rate string, err error) {
-	options := &azidentity.ManagedIdentityCredentialOptions{}
+	leadershipTransitionsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azure_spot_monitor_leadership_transitions_total",
+		Help: "The number of times this replica acquired or lost leadership",
+	}, []string{"transition"})
+)
 
-	// If a client ID is found, configure the options to use the specified user-assigned managed identity.
-	clientID := os.Getenv("AZURE_CLIENT_ID")
-	if clientID != "" {
-		options.ID = azidentity.ClientID(clientID)
-	}
+func getNodepools(subscriptionId string, resourceGroup string, cred azcore.TokenCredential, cluster string, ctx context.Context) (region string, instances map[string][]AgentPool, err error) {
+	instanceTypes := make(map[string][]AgentPool)
 
-	cred, err := azidentity.NewManagedIdentityCredential(options)
+	//Get region from AKS cluster
+	aksClient, err := armcontainerservice.NewManagedClustersClient(subscriptionId, cred, nil)
 	if err != nil {
-		return "", err
+		return "", instanceTypes, fmt.Errorf("failed to create AKS client: %w", err)
 	}
 
-	clientFactory, err := armresourcegraph.NewClientFactory(cred, nil)
+	aksResp, err := aksClient.Get(ctx, resourceGroup, cluster, nil)
 	if err != nil {
-		return "", err
+		return "", instanceTypes, fmt.Errorf("failed to get AKS cluster: %w", err)
 	}
+	region = *aksResp.Location
 
-	query := fmt.Sprintf("spotresources | where type =~ 'microsoft.compute/skuspotevictionrate/location' | where sku.name == '%s' | where location == '%s' | project spotEvictionRate = properties.evictionRate", strings.ToLower(instance), region)
-
-	res, err := clientFactory.NewClient().Resources(ctx, armresourcegraph.QueryRequest{
-		Query: to.Ptr(query),
-		Options: &armresourcegraph.QueryRequestOptions{
-			ResultFormat: to.Ptr(armresourcegraph.ResultFormatObjectArray),
-		},
-	}, nil)
+	// Create a Node Pool client
+	client, err := armcontainerservice.NewAgentPoolsClient(subscriptionId, cred, nil)
 	if err != nil {
-		return "", err
+		return "", instanceTypes, fmt.Errorf("failed to create AKS AgentPools client: %w", err)
 	}
 
-	lg.Info("fetching eviction rate was successful")
+	// Get the list of node pools
+	pager := client.NewListPager(resourceGroup, cluster, nil)
 
-	dataSlice, ok := res.Data.([]interface{})
-	if !ok {
-		return "", errors.New("query response type assertion failed")
-	}
-	//Eviction rates are (0-5%, 5-10%, 10-15%, 15-20%, 20+%)
-	var spotEvictionRate string
-	if len(dataSlice) > 0 {
-		// Type assertion to access the map
-		dataMap, ok := dataSlice[0].(map[string]interface{})
-		if !ok {
-			return "", errors.New("query response, failed to assert the first element of array as a map[string]interface{}")
+	for pager.More() {
+		resp, err := pager.NextPage(ctx)
+		if err != nil {
+			return "", instanceTypes, fmt.Errorf("failed to get node pools: %w", err)
 		}
-		// Accessing the value using the key
-		spotEvictionRateRaw := dataMap["spotEvictionRate"].(string)
-		parts := strings.Split(spotEvictionRateRaw, "-")
-		if len(parts) > 1 {
-			spotEvictionRate = parts[1]
-		} else {
-			spotEvictionRate = parts[0]
-			if strings.Contains(spotEvictionRate, "+") {
-				// Remove the '+' symbol
-				spotEvictionRate = strings.ReplaceAll(spotEvictionRate, "+", "")
-				// Increment the 20+ to 21 via string replacement
-				spotEvictionRate = strings.ReplaceAll(spotEvictionRate, "0", "1")
+
+		for _, np := range resp.Value {
+			if np.Properties.ProvisioningState == nil || *np.Properties.ProvisioningState != "Succeeded" {
+				continue
+			}
+			if np.Properties != nil && np.Properties.VMSize != nil && np.Name != nil {
+				vmSize := *np.Properties.VMSize
+				nodePoolName := *np.Name
+				props := AgentPool{
+					Name:   nodePoolName,
+					OSType: string(armcontainerservice.OSTypeLinux),
+				}
+				if np.Properties.OSType != nil {
+					props.OSType = string(*np.Properties.OSType)
+				}
+				if np.Properties.OSSKU != nil {
+					props.OSSKU = string(*np.Properties.OSSKU)
+				}
+
+				props.Overrides, err = parseOverrideTags(np.Properties.Tags)
+				if err != nil {
+					lg.WithError(err).Warnf("Ignoring invalid override tags of nodepool %s", nodePoolName)
+				}
+
+				// Keep every zone, placement scores are aggregated across them when scoring
+				for _, zone := range np.Properties.AvailabilityZones {
+					if zone != nil {
+						props.Zones = append(props.Zones, *zone)
+					}
+				}
+				if np.Properties.ScaleSetPriority != nil && *np.Properties.ScaleSetPriority == "Spot" {
+					props.Priority = "Spot"
+					if np.Properties.SpotMaxPrice != nil {
+						props.SpotMaxPrice = float64(*np.Properties.SpotMaxPrice)
+					}
+				} else {
+					if np.Properties.Mode != nil && *np.Properties.Mode == "System" {
+						continue
+					}
+					props.Priority = "Regular"
+				}
+				instanceTypes[vmSize] = append(instanceTypes[vmSize], props)
 			}
 		}
 	}
 
-	return spotEvictionRate, nil
+	return region, instanceTypes, nil
 }
 
-func getPlacementScores(region, subscriptionId string, clientID string, instances []string, ctx context.Context) (placementscores map[string]map[string]int, err error) {
-	type skuObj struct {
-		SKU string `json:"sku"`
-	}
-
-	type requestPayload struct {
-		AvailabilityZones string   `json:"availabilityZones"`
-		DesiredCount      string   `json:"desiredCount"`
-		DesiredLocations  []string `json:"desiredLocations"`
-		DesiredSizes      []skuObj `json:"desiredSizes"`
-	}
+// skuInputs are the scoring inputs derived from the price and eviction data of
+// an instance type, shared by every nodepool using it.
+type skuInputs struct {
+	Discount      float64
+	EvictionRate  float64
+	Version       int
+	SpotPrice     float64
+	BaselinePrice float64
+	Currency      string
+}
 
-	type placementScore struct {
-		SKU              string `json:"sku"`
-		AvailabilityZone string `json:"availabilityZone"`
-		Score            string `json:"score"`
-	}
+// osSKUKey identifies the scoring inputs of an instance type on an operating
+// system.
+func osSKUKey(instance, os string) string {
+	return instance + "/" + os
+}
 
-	type responsePayload struct {
-		PlacementScores []placementScore `json:"placementScores"`
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	scoreMap := map[string]int{
-		"Low":    25,
-		"Medium": 50,
-		"High":   100,
-	}
+// regionData holds the data fetched once per region and shared by every
+// cluster in it. Placement scores are kept per subscription, placementScores
+// holds those of the subscription of a single cluster.
+type regionData struct {
+	subscriptionPlacementScores map[string]map[string]map[string]int
+	placementScores             map[string]map[string]int
+	skus                        map[string]skuInputs
+}
 
-	sort.Strings(instances)
-	cacheKey := fmt.Sprintf("%s-%s-%s", region, subscriptionId, strings.Join(instances, ","))
-	placementCache.mu.Lock()
-	entry := placementCache.data
-	if entry.cacheKey == cacheKey && time.Since(entry.timestamp) < placementCache.ttl {
-		lg.Info("returning placement scores from singleton cache")
-		return entry.scores, nil
-	}
-	placementCache.mu.Unlock()
+// forSubscription returns the region data seen by the clusters of a
+// subscription.
+func (d regionData) forSubscription(subscription string) regionData {
+	d.placementScores = d.subscriptionPlacementScores[subscription]
+	return d
+}
 
-	options := &azidentity.ManagedIdentityCredentialOptions{}
+type clusterNodepools struct {
+	cluster   ClusterConfig
+	region    string
+	instances map[string][]AgentPool
+}
 
-	if clientID != "" {
-		options.ID = azidentity.ClientID(clientID)
-	}
+var versionRegexp = regexp.MustCompile("[0-9]+$")
+
+// reconcile discovers the nodepools of every cluster, fetches prices, eviction
+// rates and placement scores once per region and updates the priorities of
+// each cluster. A failing cluster or region does not stop the others, all
+// failures are joined into the returned error.
+func reconcile(ctx context.Context, cfg *viper.Viper, clusters []ClusterConfig, cred azcore.TokenCredential, pricesClient *PricesClient, evictionClient *EvictionRatesClient) error {
+	var errs []error
+	var discovered []clusterNodepools
+	regionInstances := make(map[string]map[string]bool)
+	regionInstanceOS := make(map[string]map[string]map[string]bool)
+	// Placement scores depend on the subscription, they are fetched per
+	// subscription in a region
+	regionSubscriptionInstances := make(map[string]map[string]map[string]bool)
+
+	for _, cluster := range clusters {
+		region, instances, err := getNodepools(cluster.SubscriptionID, cluster.ResourceGroup, cred, cluster.Name, ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get nodepools for cluster %s: %w", cluster.Name, err))
+			continue
+		}
+		if err := applyConfigOverrides(cfg, cluster.Name, instances); err != nil {
+			errs = append(errs, fmt.Errorf("failed to apply overrides for cluster %s: %w", cluster.Name, err))
+			continue
+		}
+		discovered = append(discovered, clusterNodepools{cluster: cluster, region: region, instances: instances})
+		health.recordSource(sourceNodepools, time.Now())
 
-	// Initialize Managed Identity credential
-	cred, err := azidentity.NewManagedIdentityCredential(options)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create managed identity credential: %w", err)
+		if _, ok := regionInstances[region]; !ok {
+			regionInstances[region] = make(map[string]bool)
+			regionInstanceOS[region] = make(map[string]map[string]bool)
+			regionSubscriptionInstances[region] = make(map[string]map[string]bool)
+		}
+		if _, ok := regionSubscriptionInstances[region][cluster.SubscriptionID]; !ok {
+			regionSubscriptionInstances[region][cluster.SubscriptionID] = make(map[string]bool)
+		}
+		for instance, pools := range instances {
+			regionInstances[region][instance] = true
+			regionSubscriptionInstances[region][cluster.SubscriptionID][instance] = true
+			if _, ok := regionInstanceOS[region][instance]; !ok {
+				regionInstanceOS[region][instance] = make(map[string]bool)
+			}
+			for _, pool := range pools {
+				regionInstanceOS[region][instance][priceOS(pool.OSType)] = true
+			}
+		}
 	}
 
-	// Get access token for ARM
-	scope := "https://management.azure.com/.default"
-	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{
-		Scopes: []string{scope},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get access token: %w", err)
+	var err error
+	regions := make(map[string]regionData)
+	// The age of a source is the age of the oldest data used in any region
+	fetched := make(map[string]time.Time)
+	observe := func(source string, fetchedAt time.Time) {
+		if !fetchedAt.IsZero() && (fetched[source].IsZero() || fetchedAt.Before(fetched[source])) {
+			fetched[source] = fetchedAt
+		}
 	}
-
-	placementApiUrl := fmt.Sprintf(
-		"https://management.azure.com/subscriptions/%s/providers/Microsoft.Compute/locations/%s/placementScores/spot/generate?api-version=2025-02-01-preview",
-		subscriptionId,
-		region,
-	)
-
-	result := make(map[string]map[string]int)
-
-	// Break instances into chunks of 5
-	for i := 0; i < len(instances); i += 5 {
-		end := i + 5
-		if end > len(instances) {
-			end = len(instances)
+	for region, instanceSet := range regionInstances {
+		instanceKeys := make([]string, 0, len(instanceSet))
+		for key := range instanceSet {
+			instanceKeys = append(instanceKeys, key)
 		}
-		chunk := instances[i:end]
+		sort.Strings(instanceKeys)
 
-		var sizes []skuObj
-		for _, sku := range chunk {
-			sizes = append(sizes, skuObj{SKU: sku})
+		placementscores := make(map[string]map[string]map[string]int)
+		placementFailed := false
+		subscriptions := make([]string, 0, len(regionSubscriptionInstances[region]))
+		for subscription := range regionSubscriptionInstances[region] {
+			subscriptions = append(subscriptions, subscription)
 		}
-
-		payload := requestPayload{
-			AvailabilityZones: "true",
-			DesiredCount:      "1",
-			DesiredLocations:  []string{region},
-			DesiredSizes:      sizes,
+		sort.Strings(subscriptions)
+		for _, subscription := range subscriptions {
+			subscriptionInstances := sortedKeys(regionSubscriptionInstances[region][subscription])
+			if leadership.isLeader() {
+				placementscores[subscription], err = getPlacementScores(region, subscription, cred, subscriptionInstances, ctx)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("failed to get placement scores for region %s in subscription %s: %w", region, subscription, err))
+					placementFailed = true
+					break
+				}
+			} else {
+				placementscores[subscription], _ = cachedPlacementScores(ctx, subscription, region, subscriptionInstances)
+			}
+			observe(sourcePlacement, placementCache.fetchedAt(subscription, region, subscriptionInstances))
+		}
+		if placementFailed {
+			continue
 		}
 
-		body, err := json.Marshal(payload)
+		lg.Infof("fetching current spot prices for %v", instanceKeys)
+		prices, err := pricesClient.GetPrices(ctx, region, instanceKeys)
 		if err != nil {
-			return nil, fmt.Errorf("failed to marshal request payload: %w", err)
+			errs = append(errs, fmt.Errorf("failed to get prices for region %s: %w", region, err))
+			continue
 		}
+		observe(sourcePrices, pricesClient.fetchedAt(region, instanceKeys))
 
-		// Create and send request
-		var resp *http.Response
-		maxRetries := 3
-		retryDelay := time.Minute
-
-		for attempt := 0; attempt < maxRetries; attempt++ {
-			req, err := http.NewRequest("POST", placementApiUrl, bytes.NewBuffer(body))
-			if err != nil {
-				return nil, fmt.Errorf("failed to create request: %w", err)
+		lg.Infof("fetching current eviction rates for %v", instanceKeys)
+		evictionRates, err := evictionClient.GetEvictionRates(ctx, region, instanceKeys)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get eviction rates for region %s: %w", region, err))
+			continue
+		}
+		observe(sourceEviction, evictionClient.fetchedAt(region, instanceKeys))
+
+		skus := make(map[string]skuInputs)
+		now := time.Now()
+		var samples []HistorySample
+		for _, instance := range instanceKeys {
+			instancePlacementScores := make(map[string]map[string]int)
+			for subscription, scores := range placementscores {
+				if zoneScores, ok := scores[instance]; ok {
+					instancePlacementScores[subscription] = zoneScores
+				}
+				// Placement scores are sampled when they were fetched, the history
+				// skips the ones already recorded from the cache
+				fetchedAt := placementCache.fetchedAt(subscription, region, []string{instance})
+				if fetchedAt.IsZero() {
+					continue
+				}
+				for zone, score := range scores[instance] {
+					samples = append(samples, HistorySample{
+						HistoryKey:   HistoryKey{Subscription: subscription, Region: region, Instance: instance, Zone: zone},
+						HistoryPoint: HistoryPoint{Timestamp: fetchedAt, PlacementScore: score},
+					})
+				}
 			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token.Token)
 
-			resp, err = http.DefaultClient.Do(req)
+			evictionBand, err := parseEvictionBand(evictionRates[instance], cfg.GetFloat64("eviction.band.open_upper"))
 			if err != nil {
-				return nil, fmt.Errorf("request failed: %w", err)
-			}
-
-			if resp.StatusCode == http.StatusTooManyRequests {
-				// Backoff and retry
-				lg.Warnf("Received 429 Too Many Requests. Retrying in %s...", retryDelay)
-				resp.Body.Close()
-				time.Sleep(retryDelay)
-				retryDelay *= 4 // Exponential backoff
+				lg.WithError(err).Error("Failed to parse eviction rate")
 				continue
 			}
+			evictionRate := evictionBand.Value(cfg.GetString("eviction.band.value"))
 
-			// Break out if it's not a 429
-			break
-		}
-
-		defer resp.Body.Close()
-		if resp.StatusCode >= 400 {
-			return nil, fmt.Errorf("API error: %s", resp.Status)
-		}
-		lg.Infof("fetching placementscore chunk %v was successful", chunk)
+			spotEvictionRateMetric.WithLabelValues(region, instance).Set(evictionRate)
+			spotEvictionRateMinMetric.WithLabelValues(region, instance).Set(evictionBand.Lower)
+			spotEvictionRateMaxMetric.WithLabelValues(region, instance).Set(evictionBand.Upper)
 
-		var parsed responsePayload
-		if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
-			return nil, fmt.Errorf("failed to decode response: %w", err)
-		}
-
-		for _, ps := range parsed.PlacementScores {
-			if _, ok := result[ps.SKU]; !ok {
-				result[ps.SKU] = make(map[string]int)
+			version := 1
+			versionString := versionRegexp.FindString(instance)
+			if versionString != "" {
+				version, _ = strconv.Atoi(versionString)
 			}
-			result[ps.SKU][ps.AvailabilityZone] = scoreMap[ps.Score]
-		}
-	}
 
-	placementCache.mu.Lock()
-	placementCache.data = placementCacheEntry{
-		cacheKey:  cacheKey,
-		timestamp: time.Now(),
-		scores:    result,
-	}
-	placementCache.mu.Unlock()
+			for _, os := range sortedKeys(regionInstanceOS[region][instance]) {
+				osPrices := prices[instance][os]
+				regularPrice, spotPrice := osPrices.Regular, osPrices.Spot
+				currency := osPrices.Currency
+				if currency == "" {
+					currency = pricesClient.currency
+				}
 
-	lg.Info("placement scores calculated and cached", "result", result)
+				// The discount is relative to what the capacity costs on the configured baseline
+				baselinePrice, ok := osPrices.Baseline(pricesClient.baseline)
+				baselineKey := pricesClient.baseline + "/" + regionSKUKey(region, osSKUKey(instance, os))
+				if ok {
+					missingPrices.found(baselineKey)
+					missingBaselinePriceMetric.WithLabelValues(region, instance, os, pricesClient.baseline).Set(0)
+				} else {
+					missingPrices.missing(baselineKey, "No %s price for %s (%s) in %s, using the pay-as-you-go price", pricesClient.baseline, instance, os, region)
+					missingBaselinePriceMetric.WithLabelValues(region, instance, os, pricesClient.baseline).Set(1)
+				}
 
-	return result, nil
-}
+				percentDiscount, ok := spotDiscount(baselinePrice, spotPrice)
+				discountKey := "discount/" + baselineKey
+				if ok {
+					missingPrices.found(discountKey)
+				} else {
+					missingPrices.missing(discountKey, "Missing spot or %s price for %s (%s) in %s, using a discount of 0", pricesClient.baseline, instance, os, region)
+				}
+				spotPriceMetric.WithLabelValues(region, instance, os, currency).Set(spotPrice)
+				spotRegularPriceMetric.WithLabelValues(region, instance, os, currency).Set(regularPrice)
+				spotDiscountMetric.WithLabelValues(region, instance, os).Set(percentDiscount)
+				if osPrices.Reserved1Y > 0 {
+					reservedPriceMetric.WithLabelValues(region, instance, os, "1y", currency).Set(osPrices.Reserved1Y)
+				}
+				if osPrices.Reserved3Y > 0 {
+					reservedPriceMetric.WithLabelValues(region, instance, os, "3y", currency).Set(osPrices.Reserved3Y)
+				}
 
-func getNodepools(subscriptionId string, resourceGroup string, clientID string, cluster string, ctx context.Context) (region string, instances map[string][]map[string]string, err error) {
-	instanceTypes := make(map[string][]map[string]string)
+				skus[osSKUKey(instance, os)] = skuInputs{
+					Discount:      percentDiscount,
+					EvictionRate:  evictionRate,
+					Version:       version,
+					SpotPrice:     spotPrice,
+					BaselinePrice: baselinePrice,
+					Currency:      currency,
+				}
+				samples = append(samples, HistorySample{
+					HistoryKey: HistoryKey{Region: region, Instance: instance, OS: os},
+					HistoryPoint: HistoryPoint{
+						Timestamp:       now,
+						SpotPrice:       spotPrice,
+						RegularPrice:    regularPrice,
+						EvictionRateMin: evictionBand.Lower,
+						EvictionRateMax: evictionBand.Upper,
+					},
+				})
+				latest.recordSKU(SKUStatus{
+					Region:          region,
+					Instance:        instance,
+					OS:              os,
+					RegularPrice:    regularPrice,
+					SpotPrice:       spotPrice,
+					Reserved1Y:      osPrices.Reserved1Y,
+					Reserved3Y:      osPrices.Reserved3Y,
+					SavingsPlan1Y:   osPrices.SavingsPlan1Y,
+					SavingsPlan3Y:   osPrices.SavingsPlan3Y,
+					Baseline:        pricesClient.baseline,
+					BaselinePrice:   baselinePrice,
+					Currency:        currency,
+					Discount:        percentDiscount,
+					EvictionBand:    evictionBand,
+					EvictionRate:    evictionRate,
+					PlacementScores: instancePlacementScores,
+					Version:         version,
+					UpdatedAt:       time.Now(),
+				})
+			}
+		}
 
-	options := &azidentity.ManagedIdentityCredentialOptions{}
+		if err := history.Record(samples, now); err != nil {
+			lg.WithError(err).Warnf("Failed to record spot signal history for region %s", region)
+		}
 
-	// If a client ID is found, configure the options to use the specified user-assigned managed identity.
-	if clientID != "" {
-		options.ID = azidentity.ClientID(clientID)
+		regions[region] = regionData{subscriptionPlacementScores: placementscores, skus: skus}
 	}
 
-	cred, err := azidentity.NewManagedIdentityCredential(options)
-	if err != nil {
-		lg.WithError(err).Fatal("Failed to obtain Azure credentials")
-		return "", instanceTypes, err
+	for source, fetchedAt := range fetched {
+		health.recordSource(source, fetchedAt)
 	}
 
-	//Get region from AKS cluster
-	aksClient, err := armcontainerservice.NewManagedClustersClient(subscriptionId, cred, nil)
-	if err != nil {
-		lg.WithError(err).Fatal("Failed to create AKS client")
-		return "", instanceTypes, err
-	}
+	for _, c := range discovered {
+		data, ok := regions[c.region]
+		if !ok {
+			continue
+		}
 
-	aksResp, err := aksClient.Get(context.Background(), resourceGroup, cluster, nil)
-	if err != nil {
-		lg.WithError(err).Fatal("Failed to get AKS cluster")
-		return "", instanceTypes, err
-	}
-	region = *aksResp.Location
+		aggregation := currentZoneAggregation()
+		var nodeCounts map[string]map[string]int
+		if aggregation == "weighted" {
+			nodeCounts, err = clusterNodeCounts(ctx, cfg, c.cluster)
+			if err != nil {
+				lg.WithError(err).Warnf("Failed to count nodes for cluster %s, using mean placement score", c.cluster.Name)
+			}
+		}
 
-	// Create a Node Pool client
-	client, err := armcontainerservice.NewAgentPoolsClient(subscriptionId, cred, nil)
-	if err != nil {
-		lg.WithError(err).Fatal("Failed to create AKS AgentPools client")
-		return "", instanceTypes, err
+		nodePools := buildNodepools(c.cluster.Name, c.region, c.instances, data.forSubscription(c.cluster.SubscriptionID), aggregation, nodeCounts)
+		history.applyPlacementTrends(c.cluster.SubscriptionID, c.region, nodePools, cfg.GetDuration("scoring.trend.window"), time.Now())
+		err = updateConfigMap(ctx, cfg, c.cluster, nodePools)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update configmap for cluster %s: %w", c.cluster.Name, err))
+			continue
+		}
+		// A dry-run writes nothing, it must not look like a configmap update
+		if leadership.isLeader() && !cfg.GetBool("dryrun.enabled") {
+			health.recordConfigMapUpdate(c.cluster.Name)
+		}
 	}
 
-	// Get the list of node pools
-	pager := client.NewListPager(resourceGroup, cluster, nil)
+	return errors.Join(errs...)
+}
 
-	for pager.More() {
-		resp, err := pager.NextPage(ctx)
-		if err != nil {
-			lg.WithError(err).Fatal("Failed to get node pools")
-			return "", instanceTypes, err
-		}
+func buildNodepools(cluster, region string, instances map[string][]AgentPool, data regionData, aggregation string, nodeCounts map[string]map[string]int) NodepoolMap {
+	nodePools := make(NodepoolMap)
 
-		for _, np := range resp.Value {
-			if np.Properties.ProvisioningState == nil || *np.Properties.ProvisioningState != "Succeeded" {
+	for instance, nodepool := range instances {
+		for _, node := range nodepool {
+			sku, ok := data.skus[osSKUKey(instance, priceOS(node.OSType))]
+			if !ok {
 				continue
 			}
-			if np.Properties != nil && np.Properties.VMSize != nil && np.Name != nil {
-				vmSize := *np.Properties.VMSize
-				nodePoolName := *np.Name
-				props := map[string]string{
-					"name": nodePoolName,
-				}
 
-				/**
-				Select one zone for nodepools with more than one zone assigned,
-				as the request for a VM will still pick an arbitrary zone
-				**/
-				if len(np.Properties.AvailabilityZones) > 0 {
-					props["zone"] = *np.Properties.AvailabilityZones[0]
+			if node.Priority == "Spot" {
+				zoneScores := make(map[string]int)
+				for zone, score := range data.placementScores[instance] {
+					if len(node.Zones) == 0 || slices.Contains(node.Zones, zone) {
+						zoneScores[zone] = score
+						spotPlacementScoreMetric.WithLabelValues(region, instance, zone).Set(float64(score))
+					}
 				}
-				if np.Properties.ScaleSetPriority != nil && *np.Properties.ScaleSetPriority == "Spot" {
-					props["priority"] = "Spot"
-				} else {
-					if np.Properties.Mode != nil && *np.Properties.Mode == "System" {
-						continue
+				nodePool := Nodepool{
+					Name:                node.Name,
+					Instance:            instance,
+					Price:               sku.SpotPrice,
+					Currency:            sku.Currency,
+					SpotMaxPrice:        node.SpotMaxPrice,
+					Discount:            sku.Discount,
+					EvictionRate:        sku.EvictionRate,
+					PlacementScore:      aggregatePlacementScores(aggregation, data.placementScores[instance], node.Zones, nodeCounts[node.Name]),
+					ZonePlacementScores: zoneScores,
+					Version:             sku.Version,
+					Type:                "Spot",
+					OSType:              node.OSType,
+					OSSKU:               node.OSSKU,
+					Overrides:           node.Overrides,
+				}
+				if nodePool.capped() {
+					spotMaxPriceHeadroomMetric.WithLabelValues(cluster, node.Name, region, instance, nodePool.Currency).Set(nodePool.maxPriceHeadroom())
+					if nodePool.overMaxPrice() {
+						lg.Warnf("Spot price %g of nodepool %s in cluster %s exceeds its max price %g", nodePool.Price, node.Name, cluster, nodePool.SpotMaxPrice)
 					}
-					props["priority"] = "Regular"
 				}
-				instanceTypes[vmSize] = append(instanceTypes[vmSize], props)
+				// Append the Nodepool object to the corresponding slice
+				nodePools[node.Name] = nodePool
+			} else {
+				// Regular nodepools pay the baseline price, are never evicted and are
+				// not limited by spot capacity. Their rank against spot nodepools is
+				// set by regular.placement.
+				nodePool := Nodepool{
+					Name:           node.Name,
+					Instance:       instance,
+					Price:          sku.BaselinePrice,
+					Currency:       sku.Currency,
+					Discount:       0,
+					EvictionRate:   0,
+					PlacementScore: 100,
+					Version:        sku.Version,
+					Type:           "Regular",
+					OSType:         node.OSType,
+					OSSKU:          node.OSSKU,
+					Overrides:      node.Overrides,
+				}
+				nodePools[node.Name] = nodePool
 			}
 		}
 	}
 
-	return region, instanceTypes, nil
+	return nodePools
 }
 
 func main() {
@@ -457,9 +605,22 @@ func main() {
 	if err == nil {
 		lg.SetLevel(logLevel)
 	}
-	versionRegexp := regexp.MustCompile("[0-9]+$")
+
+	clusters, err := loadClusters(cfg)
+	if err != nil {
+		lg.WithError(err).Fatal("Invalid cluster config")
+	}
+
+	validateNodeGroupPatterns(ctx, cfg, clusters)
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/dryrun", dryRunHandler)
+	http.HandleFunc("/healthz", healthzHandler(cfg, clusters))
+	http.HandleFunc("/readyz", readyzHandler(cfg, clusters))
+	http.HandleFunc("/api/v1/nodepools", nodepoolsHandler)
+	http.HandleFunc("/api/v1/priorities", prioritiesHandler)
+	http.HandleFunc("/api/v1/skus", skusHandler)
+	http.HandleFunc("/api/v1/history", historyHandler)
 
 	go func() {
 		err := http.ListenAndServe(cfg.GetString("metrics.addr"), nil)
@@ -470,117 +631,54 @@ func main() {
 	}()
 	lg.Info("started prometheus listener")
 
-	ticker := time.NewTicker(time.Second * time.Duration(cfg.GetInt("time.interval")))
-
-	subscriptionId := cfg.GetString("subscription.id")
-	if subscriptionId == "" {
-		lg.Fatal("Missing required config: subscription.id")
-	}
-	resourceGroup := cfg.GetString("resource.group")
-	if resourceGroup == "" {
-		lg.Fatal("Missing required config: resource.group")
+	cred, err := newCredential(cfg)
+	if err != nil {
+		lg.WithError(err).Fatal("Failed to obtain Azure credentials")
 	}
-	clusterName := cfg.GetString("cluster.name")
-	if clusterName == "" {
-		lg.Fatal("Missing required config: cluster.name")
+
+	// Followers never fetch placement scores, they need the leader's cache
+	if cfg.GetBool("leaderelection.enabled") && cfg.GetString("placement.cache.persist") != "configmap" {
+		lg.Fatal("leaderelection.enabled requires placement.cache.persist: configmap to share placement scores with followers")
 	}
-	clientId := cfg.GetString("azure.client.id")
-	if clientId == "" {
-		lg.Fatal("Missing required config: azure.client.id")
+	setupPlacementCache(ctx, cfg)
+	setupHistory(cfg)
+	pricesClient, err := newPricesClient(cfg)
+	if err != nil {
+		lg.WithError(err).Fatal("Invalid pricing config")
 	}
-
-	for {
-		region, instances, err := getNodepools(subscriptionId, resourceGroup, clientId, clusterName, ctx)
-		if err != nil {
-			lg.WithError(err).Error("Failed to get nodepools")
-			return
-		}
-
-		instanceKeys := make([]string, 0, len(instances))
-		for key := range instances {
-			instanceKeys = append(instanceKeys, key)
-		}
-
-		placementscores, err := getPlacementScores(region, subscriptionId, clientId, instanceKeys, ctx)
-		if err != nil {
-			lg.WithError(err).Error("Failed to get placement scores")
-			return
-		}
-
-		nodePools := make(NodepoolMap)
-
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-
-			for instance, nodepool := range instances {
-				lg.Infof("fetching current spot prices for %s", instance)
-				regularPrice, spotPrice, err := getPrices(region, instance, cfg.GetString("api.url"))
-				if err != nil {
-					lg.WithError(err).Error("Failed to get prices")
-					continue
-				}
-
-				lg.Infof("fetching current eviction rates for %s", instance)
-				evictionRateStr, err := getEvictionRates(region, instance, ctx)
-				if err != nil {
-					lg.WithError(err).Error("Failed to get eviction rate")
-					continue
-				}
-
-				evictionRate, err := strconv.Atoi(evictionRateStr)
-				if err != nil && evictionRateStr == "" {
-					evictionRate = 0
-				} else if err != nil {
-					lg.WithError(err).Error("Failed to convert eviction rate to int")
-					continue
-				}
-				percentDiscount := ((regularPrice - spotPrice) / regularPrice)
-				spotPriceMetric.WithLabelValues(region, instance).Set(spotPrice)
-				spotRegularPriceMetric.WithLabelValues(region, instance).Set(regularPrice)
-				spotDiscountMetric.WithLabelValues(region, instance).Set(percentDiscount)
-				spotEvictionRateMetric.WithLabelValues(region, instance).Set(float64(evictionRate) / 100)
-
-				version := 1
-				versionString := versionRegexp.FindString(instance)
-				if versionString != "" {
-					version, _ = strconv.Atoi(versionString)
-				}
-
-				for _, node := range nodepool {
-					if node["priority"] == "Spot" {
-						nodePool := Nodepool{
-							Name:           node["name"],
-							Discount:       percentDiscount,
-							EvictionRate:   float64(evictionRate) / 100,
-							PlacementScore: placementscores[instance][node["zone"]],
-							Version:        version,
-							Type:           "Spot",
-						}
-						// Append the Nodepool object to the corresponding slice
-						nodePools[node["name"]] = nodePool
-						spotPlacementScoreMetric.WithLabelValues(region, instance, node["zone"]).Set(float64(placementscores[instance][node["zone"]]))
-					} else {
-						nodePool := Nodepool{
-							Name:           node["name"],
-							Discount:       0.5,
-							EvictionRate:   0.2,
-							PlacementScore: 45,
-							Version:        2,
-							Type:           "Regular",
-						}
-						nodePools[node["name"]] = nodePool
-					}
+	evictionClient, err := newEvictionRatesClient(cfg, cred)
+	if err != nil {
+		lg.WithError(err).Fatal("Failed to create eviction rates client")
+	}
+	health.setSourceTTL(sourcePrices, cfg.GetDuration("api.cache.ttl"))
+	health.setSourceTTL(sourceEviction, cfg.GetDuration("eviction.cache.ttl"))
+	health.setSourceTTL(sourcePlacement, placementCache.ttl)
+
+	wake := make(chan struct{}, 1)
+	if cfg.GetBool("leaderelection.enabled") {
+		leadership.enabled.Store(true)
+		go func() {
+			err := runLeaderElection(ctx, cfg, func() {
+				// Refresh the priorities right away on becoming the leader
+				select {
+				case wake <- struct{}{}:
+				default:
 				}
-			}
-
-			err = updateConfigMap(ctx, cfg, nodePools)
+			})
 			if err != nil {
-				lg.WithError(err).Error("Failed to update configmap")
-				continue
+				lg.WithError(err).Fatal("Failed to start leader election")
 			}
+		}()
+	} else {
+		leaderMetric.Set(1)
+	}
 
-		}
+	loop := &supervisor{
+		cfg: cfg,
+		reconcile: func(ctx context.Context) error {
+			return reconcile(ctx, cfg, clusters, cred, pricesClient, evictionClient)
+		},
+		wake: wake,
 	}
+	loop.run(ctx)
 }
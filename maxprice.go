@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// maxPriceCurrency is the currency of the SpotMaxPrice of agent pools, max
+// prices are only compared with spot prices fetched in it.
+const maxPriceCurrency = "USD"
+
+// maxPriceScorer demotes spot nodepools whose spot price approaches their
+// SpotMaxPrice, as they risk price based eviction whatever the capacity. Pools
+// within pricing.maxprice.margin of their cap lose pricing.maxprice.penalty
+// points, scaled to the wrapped Scorer, pools over their cap are ranked below
+// every other nodepool.
+type maxPriceScorer struct {
+	Scorer
+	margin  float64
+	penalty int
+}
+
+func (s maxPriceScorer) Score(nodePools NodepoolMap) map[string]int {
+	scores := s.Scorer.Score(nodePools)
+	if len(scores) == 0 {
+		return scores
+	}
+
+	lowest := 0
+	first := true
+	for _, score := range scores {
+		if first || score < lowest {
+			lowest, first = score, false
+		}
+	}
+
+	for key := range scores {
+		np := nodePools[key]
+		switch {
+		case np.overMaxPrice():
+			scores[key] = lowest - 1
+		case np.nearMaxPrice(s.margin):
+			scores[key] -= s.penalty
+		}
+	}
+	return keepPositive(scores)
+}
+
+func (s maxPriceScorer) scalePenalty(points int) int {
+	return scaledPenalty(s.Scorer, points)
+}
+
+func newMaxPriceScorer(cfg *viper.Viper, scorer Scorer) Scorer {
+	if currency := strings.ToUpper(cfg.GetString("pricing.currency")); currency != "" && currency != maxPriceCurrency {
+		lg.Warnf("spot max prices are in %s, nodepools are not scored by their max price with %s prices", maxPriceCurrency, currency)
+	}
+	return maxPriceScorer{
+		Scorer:  scorer,
+		margin:  cfg.GetFloat64("pricing.maxprice.margin"),
+		penalty: scaledPenalty(scorer, cfg.GetInt("pricing.maxprice.penalty")),
+	}
+}
+
+// capped reports whether a spot nodepool has a SpotMaxPrice comparable with
+// its spot price, -1 or no value means it pays up to the pay-as-you-go price.
+func (np Nodepool) capped() bool {
+	return np.Type == "Spot" && np.SpotMaxPrice > 0 && np.Currency == maxPriceCurrency
+}
+
+// maxPriceHeadroom is how far the spot price is below the SpotMaxPrice.
+func (np Nodepool) maxPriceHeadroom() float64 {
+	return np.SpotMaxPrice - np.Price
+}
+
+func (np Nodepool) overMaxPrice() bool {
+	return np.capped() && np.maxPriceHeadroom() < 0
+}
+
+// nearMaxPrice reports whether the headroom is below margin, a fraction of
+// the SpotMaxPrice.
+func (np Nodepool) nearMaxPrice(margin float64) bool {
+	return np.capped() && np.maxPriceHeadroom() < margin*np.SpotMaxPrice
+}
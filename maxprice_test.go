@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxPriceScorer(t *testing.T) {
+	nodePools := NodepoolMap{
+		"uncapped": {Name: "uncapped", Type: "Spot", Price: 0.1, Currency: "USD", SpotMaxPrice: -1},
+		"roomy":    {Name: "roomy", Type: "Spot", Price: 0.1, Currency: "USD", SpotMaxPrice: 0.2},
+		"near":     {Name: "near", Type: "Spot", Price: 0.19, Currency: "USD", SpotMaxPrice: 0.2},
+		"over":     {Name: "over", Type: "Spot", Price: 0.25, Currency: "USD", SpotMaxPrice: 0.2},
+		"general":  {Name: "general", Type: "Regular", Price: 0.4, Currency: "USD"},
+	}
+	scores := fixedScorer{"uncapped": 30, "roomy": 30, "near": 30, "over": 40, "general": 20}
+
+	cfg := viper.New()
+	cfg.Set("pricing.maxprice.margin", 0.1)
+	cfg.Set("pricing.maxprice.penalty", 10)
+	scorer := newMaxPriceScorer(cfg, scores)
+
+	assert.Equal(t, map[string]int{"uncapped": 30, "roomy": 30, "near": 20, "over": 19, "general": 20}, scorer.Score(nodePools))
+
+	assert.InDelta(t, 0.1, nodePools["roomy"].maxPriceHeadroom(), 1e-9)
+	assert.True(t, nodePools["over"].overMaxPrice())
+	assert.False(t, nodePools["uncapped"].capped())
+	assert.False(t, nodePools["general"].capped())
+
+	// Max prices in USD are not compared with prices in another currency
+	euro := nodePools["over"]
+	euro.Currency = "EUR"
+	assert.False(t, euro.capped())
+}
+
+func TestMaxPricePenaltyScale(t *testing.T) {
+	nodePools := NodepoolMap{
+		"roomy": {Name: "roomy", Type: "Spot", PlacementScore: 100, Price: 0.1, Currency: "USD", SpotMaxPrice: 0.2},
+		"near":  {Name: "near", Type: "Spot", PlacementScore: 100, Price: 0.19, Currency: "USD", SpotMaxPrice: 0.2},
+		"low":   {Name: "low", Type: "Spot", PlacementScore: 50, Price: 0.1, Currency: "USD"},
+		"over":  {Name: "over", Type: "Spot", PlacementScore: 25, Price: 0.25, Currency: "USD", SpotMaxPrice: 0.2},
+	}
+
+	cfg := viper.New()
+	cfg.Set("pricing.maxprice.margin", 0.1)
+	cfg.Set("pricing.maxprice.penalty", 10)
+	scorer := newMaxPriceScorer(cfg, newTrendScorer(cfg, lexicographicScorer{order: []string{"placement"}}))
+
+	// A near cap pool loses one rank, priorities stay positive
+	assert.Equal(t, map[string]int{"roomy": 4, "near": 3, "low": 3, "over": 1}, scorer.Score(nodePools))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ownedPatternsAnnotation lists the priority patterns written by the monitor
+// in merge mode. Every other entry of the configmap is left alone.
+const ownedPatternsAnnotation = "spot-monitor/owned-patterns"
+
+// Conflict policies for rendered patterns that already exist as foreign
+// entries.
+const (
+	conflictOverride = "override"
+	conflictPreserve = "preserve"
+	conflictRefuse   = "refuse"
+)
+
+// ownedPatterns reads the ownership annotation. ok is false when the
+// configmap was never written in merge mode.
+func ownedPatterns(cm *corev1.ConfigMap) (owned map[string]bool, ok bool, err error) {
+	raw, ok := cm.Annotations[ownedPatternsAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+	var patterns []string
+	if err := json.Unmarshal([]byte(raw), &patterns); err != nil {
+		return nil, true, fmt.Errorf("invalid %s annotation: %w", ownedPatternsAnnotation, err)
+	}
+	owned = make(map[string]bool, len(patterns))
+	for _, pattern := range patterns {
+		owned[pattern] = true
+	}
+	return owned, true, nil
+}
+
+func ownedPatternsValue(patterns []string) string {
+	sort.Strings(patterns)
+	raw, _ := json.Marshal(patterns)
+	return string(raw)
+}
+
+// mergePriorities combines the rendered priorities with the foreign entries
+// of the current ones, the entries not listed in owned. Previously owned
+// entries that are no longer rendered are dropped. A rendered pattern that is
+// also a foreign entry is resolved with policy: override takes it over,
+// preserve keeps the foreign entry and refuse fails the merge. It returns the
+// merged priorities and the patterns now owned by the monitor.
+func mergePriorities(current, rendered map[int][]string, owned map[string]bool, policy string) (map[int][]string, []string, error) {
+	foreign := make(map[string]int)
+	for priority, patterns := range current {
+		for _, pattern := range patterns {
+			if !owned[pattern] {
+				foreign[pattern] = priority
+			}
+		}
+	}
+
+	merged := make(map[int][]string)
+	var nowOwned []string
+	for priority, patterns := range rendered {
+		for _, pattern := range patterns {
+			if foreignPriority, ok := foreign[pattern]; ok {
+				switch policy {
+				case conflictOverride:
+					lg.Warnf("Taking over foreign priority entry %s (%d -> %d)", pattern, foreignPriority, priority)
+					delete(foreign, pattern)
+				case conflictRefuse:
+					return nil, nil, fmt.Errorf("pattern %s is managed outside of the monitor at priority %d", pattern, foreignPriority)
+				default:
+					lg.Warnf("Keeping foreign priority entry %s at %d instead of %d", pattern, foreignPriority, priority)
+					continue
+				}
+			}
+			merged[priority] = append(merged[priority], pattern)
+			nowOwned = append(nowOwned, pattern)
+		}
+	}
+	for pattern, priority := range foreign {
+		merged[priority] = append(merged[priority], pattern)
+	}
+
+	for _, patterns := range merged {
+		sort.Strings(patterns)
+	}
+	sort.Strings(nowOwned)
+
+	return merged, nowOwned, nil
+}
+
+// legacyNodeGroupPattern is the pattern written for a nodepool before
+// pattern.template existed.
+func legacyNodeGroupPattern(name string) string {
+	return fmt.Sprintf(".*%s.*", strings.TrimSpace(name))
+}
+
+// mergeConfigMapPriorities merges the rendered priorities into the ones of
+// an existing cluster-autoscaler configmap. A configmap without the ownership
+// annotation was last written in replace mode, its entries matching rendered
+// patterns or the legacy patterns of the nodepools are adopted.
+func mergeConfigMapPriorities(cm *corev1.ConfigMap, nodePools NodepoolMap, rendered map[int][]string, policy string) (map[int][]string, []string, error) {
+	current := make(map[int][]string)
+	if err := yaml.Unmarshal([]byte(cm.Data["priorities"]), &current); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse current priorities: %w", err)
+	}
+
+	owned, ok, err := ownedPatterns(cm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		owned = make(map[string]bool)
+		for _, patterns := range rendered {
+			for _, pattern := range patterns {
+				owned[pattern] = true
+			}
+		}
+		for _, np := range nodePools {
+			owned[legacyNodeGroupPattern(np.Name)] = true
+		}
+	}
+
+	return mergePriorities(current, rendered, owned, policy)
+}
+
+// enforceMergedSpotSafety applies safety.policy to merged priorities. Only
+// owned Regular patterns are demoted, foreign entries are never rewritten: when
+// one of them ranks a Regular nodepool at or above every Spot nodepool, or the
+// owned ones have no room below the best Spot nodepool, demote refuses the
+// write instead.
+func enforceMergedSpotSafety(policy string, nodePools NodepoolMap, merged map[int][]string, owned []string) (map[int][]string, error) {
+	if policy != "demote" || checkSpotIsSafe(nodePools, merged) {
+		return enforceSpotSafety(policy, nodePools, merged)
+	}
+
+	best, _ := bestSpotPriority(nodePools, merged)
+	regularPatterns := make(map[string]bool)
+	for _, np := range nodePools {
+		if np.Type == "Regular" {
+			regularPatterns[nodeGroupPattern(np.Name)] = true
+		}
+	}
+	ownedPatterns := make(map[string]bool, len(owned))
+	for _, pattern := range owned {
+		ownedPatterns[pattern] = true
+	}
+
+	demoted := make(map[int][]string)
+	for priority, patterns := range merged {
+		for _, pattern := range patterns {
+			target := priority
+			if priority >= best && regularPatterns[pattern] {
+				if !ownedPatterns[pattern] {
+					spotSafetyDecisionMetric.WithLabelValues(policy, "refused").Inc()
+					return nil, fmt.Errorf("refusing to write priorities, foreign entry %s ranks a regular nodepool at or above every spot nodepool", pattern)
+				}
+				if best <= 1 {
+					spotSafetyDecisionMetric.WithLabelValues(policy, "refused").Inc()
+					return nil, fmt.Errorf("refusing to write priorities, no room to demote %s below priority %d", pattern, best)
+				}
+				target = best - 1
+				lg.Warnf("demoting regular nodepool %s from priority %d to %d", pattern, priority, target)
+			}
+			demoted[target] = append(demoted[target], pattern)
+		}
+	}
+	for _, patterns := range demoted {
+		sort.Strings(patterns)
+	}
+	spotSafetyDecisionMetric.WithLabelValues(policy, "demoted").Inc()
+
+	return demoted, nil
+}
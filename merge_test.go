@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergePriorities(t *testing.T) {
+	current := map[int][]string{
+		1:  {".*"},
+		10: {".*spota.*", ".*batch.*"},
+		20: {".*spotb.*", ".*spotc.*"},
+	}
+	owned := map[string]bool{".*spota.*": true, ".*spotb.*": true}
+	rendered := map[int][]string{
+		10: {".*spotb.*"},
+		20: {".*spotc.*"},
+		30: {".*spotd.*"},
+	}
+
+	tests := []struct {
+		policy   string
+		merged   map[int][]string
+		nowOwned []string
+	}{
+		{
+			policy: conflictPreserve,
+			merged: map[int][]string{
+				1:  {".*"},
+				10: {".*batch.*", ".*spotb.*"},
+				20: {".*spotc.*"},
+				30: {".*spotd.*"},
+			},
+			nowOwned: []string{".*spotb.*", ".*spotd.*"},
+		},
+		{
+			policy: conflictOverride,
+			merged: map[int][]string{
+				1:  {".*"},
+				10: {".*batch.*", ".*spotb.*"},
+				20: {".*spotc.*"},
+				30: {".*spotd.*"},
+			},
+			nowOwned: []string{".*spotb.*", ".*spotc.*", ".*spotd.*"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			merged, nowOwned, err := mergePriorities(current, rendered, owned, tt.policy)
+			require.NoError(t, err)
+			assert.Equal(t, tt.merged, merged)
+			assert.Equal(t, tt.nowOwned, nowOwned)
+		})
+	}
+
+	_, _, err := mergePriorities(current, rendered, owned, conflictRefuse)
+	assert.Error(t, err)
+}
+
+func TestMergeConfigMapPriorities(t *testing.T) {
+	rendered := map[int][]string{20: {".*spota.*"}}
+
+	// Without the annotation, entries matching rendered patterns are adopted
+	cm := &corev1.ConfigMap{Data: map[string]string{"priorities": "1:\n    - .*\n10:\n    - .*spota.*\n"}}
+	merged, owned, err := mergeConfigMapPriorities(cm, nil, rendered, conflictRefuse)
+	require.NoError(t, err)
+	assert.Equal(t, map[int][]string{1: {".*"}, 20: {".*spota.*"}}, merged)
+	assert.Equal(t, []string{".*spota.*"}, owned)
+
+	cm.ObjectMeta = metav1.ObjectMeta{Annotations: map[string]string{ownedPatternsAnnotation: `[]`}}
+	_, _, err = mergeConfigMapPriorities(cm, nil, rendered, conflictRefuse)
+	assert.Error(t, err)
+
+	cm.Annotations[ownedPatternsAnnotation] = "not json"
+	_, _, err = mergeConfigMapPriorities(cm, nil, rendered, conflictPreserve)
+	assert.Error(t, err)
+
+	// Upgrading from replace mode with the legacy patterns claims them too,
+	// so they are replaced instead of being kept as foreign entries
+	nodePools := NodepoolMap{"spota": {Name: "spota", Type: "Spot"}, "general": {Name: "general", Type: "Regular"}}
+	upgraded := map[int][]string{20: {nodeGroupPattern("spota")}, 10: {nodeGroupPattern("general")}}
+	legacy := &corev1.ConfigMap{Data: map[string]string{"priorities": "1:\n    - .*\n10:\n    - .*general.*\n    - .*unmanaged.*\n20:\n    - .*spota.*\n"}}
+	merged, owned, err = mergeConfigMapPriorities(legacy, nodePools, upgraded, conflictRefuse)
+	require.NoError(t, err)
+	assert.Equal(t, map[int][]string{
+		1:  {".*"},
+		10: {".*unmanaged.*", nodeGroupPattern("general")},
+		20: {nodeGroupPattern("spota")},
+	}, merged)
+	assert.Equal(t, []string{nodeGroupPattern("general"), nodeGroupPattern("spota")}, owned)
+}
+
+func TestEnforceMergedSpotSafety(t *testing.T) {
+	nodePools := NodepoolMap{
+		"general": {Name: "general", Type: "Regular"},
+		"batch":   {Name: "batch", Type: "Regular"},
+		"spota":   {Name: "spota", Type: "Spot"},
+	}
+	general, batch, spota := nodeGroupPattern("general"), nodeGroupPattern("batch"), nodeGroupPattern("spota")
+
+	// A preserved foreign spot entry ranks below the owned regular nodepool,
+	// only the owned pattern moves
+	merged := map[int][]string{1: {".*"}, 5: {spota}, 10: {general}}
+	demoted, err := enforceMergedSpotSafety("demote", nodePools, merged, []string{general})
+	require.NoError(t, err)
+	assert.Equal(t, map[int][]string{1: {".*"}, 4: {general}, 5: {spota}}, demoted)
+
+	// Foreign regular entries are never rewritten
+	merged = map[int][]string{10: {batch}, 20: {spota}, 30: {general}}
+	_, err = enforceMergedSpotSafety("demote", nodePools, merged, []string{spota})
+	assert.Error(t, err)
+	alerted, err := enforceMergedSpotSafety("alert", nodePools, merged, []string{spota})
+	require.NoError(t, err)
+	assert.Equal(t, merged, alerted)
+
+	// No room below the best spot nodepool without renumbering foreign entries
+	_, err = enforceMergedSpotSafety("demote", nodePools, map[int][]string{1: {general, spota}}, []string{general})
+	assert.Error(t, err)
+}
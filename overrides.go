@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Agent pool tags overriding how a nodepool is prioritised.
+const (
+	excludeTag    = "spot-monitor/exclude"
+	priorityTag   = "spot-monitor/priority"
+	weightBiasTag = "spot-monitor/weight-bias"
+)
+
+// NodepoolOverrides pins, excludes or biases the priority of a nodepool. They
+// are read from the agent pool tags, or from the overrides config when the
+// pool has none of the tags.
+type NodepoolOverrides struct {
+	Exclude    bool   `json:"exclude,omitempty" mapstructure:"exclude"`
+	Priority   *int   `json:"priority,omitempty" mapstructure:"priority"`
+	WeightBias int    `json:"weightBias,omitempty" mapstructure:"weightBias"`
+	Source     string `json:"source" mapstructure:"-"`
+}
+
+func (o NodepoolOverrides) String() string {
+	var parts []string
+	if o.Exclude {
+		parts = append(parts, "exclude")
+	}
+	if o.Priority != nil {
+		parts = append(parts, fmt.Sprintf("priority=%d", *o.Priority))
+	}
+	if o.WeightBias != 0 {
+		parts = append(parts, fmt.Sprintf("weight-bias=%+d", o.WeightBias))
+	}
+	return fmt.Sprintf("%s from %s", strings.Join(parts, " "), o.Source)
+}
+
+// apply returns the priority of a nodepool scored at priority, and false when
+// the nodepool is excluded.
+func (o *NodepoolOverrides) apply(priority int) (int, bool) {
+	if o == nil {
+		return priority, true
+	}
+	if o.Exclude {
+		return 0, false
+	}
+	if o.Priority != nil {
+		return *o.Priority, true
+	}
+	return priority + o.WeightBias, true
+}
+
+// parseOverrideTags reads the spot-monitor tags of an agent pool. It returns
+// nil when the pool has none of them. Invalid tags are reported and skipped.
+func parseOverrideTags(tags map[string]*string) (*NodepoolOverrides, error) {
+	var overrides *NodepoolOverrides
+	var errs []string
+
+	for _, key := range []string{excludeTag, priorityTag, weightBiasTag} {
+		raw, ok := tags[key]
+		if !ok || raw == nil {
+			continue
+		}
+		if overrides == nil {
+			overrides = &NodepoolOverrides{Source: "tags"}
+		}
+		value := strings.TrimSpace(*raw)
+
+		switch key {
+		case excludeTag:
+			exclude, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s=%q is not a boolean", key, value))
+				continue
+			}
+			overrides.Exclude = exclude
+		case priorityTag:
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s=%q is not an integer", key, value))
+				continue
+			}
+			overrides.Priority = &priority
+		case weightBiasTag:
+			bias, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s=%q is not an integer", key, value))
+				continue
+			}
+			overrides.WeightBias = bias
+		}
+	}
+
+	if len(errs) > 0 {
+		return overrides, fmt.Errorf("invalid override tags: %s", strings.Join(errs, ", "))
+	}
+	return overrides, nil
+}
+
+// configOverrides returns the overrides of a nodepool from the overrides
+// config, keyed by "<cluster>/<nodepool>" or "<nodepool>".
+func configOverrides(cfg *viper.Viper, cluster, nodepool string) (*NodepoolOverrides, error) {
+	all := make(map[string]NodepoolOverrides)
+	if err := cfg.UnmarshalKey("overrides", &all); err != nil {
+		return nil, fmt.Errorf("invalid overrides config: %w", err)
+	}
+
+	// viper lowercases keys
+	for _, key := range []string{strings.ToLower(cluster + "/" + nodepool), strings.ToLower(nodepool)} {
+		if overrides, ok := all[key]; ok {
+			overrides.Source = "config"
+			return &overrides, nil
+		}
+	}
+	return nil, nil
+}
+
+// applyConfigOverrides falls back to the overrides config for the agent
+// pools of a cluster without override tags.
+func applyConfigOverrides(cfg *viper.Viper, cluster string, instances map[string][]AgentPool) error {
+	for _, pools := range instances {
+		for i := range pools {
+			if pools[i].Overrides != nil {
+				continue
+			}
+			overrides, err := configOverrides(cfg, cluster, pools[i].Name)
+			if err != nil {
+				return err
+			}
+			pools[i].Overrides = overrides
+		}
+	}
+	return nil
+}
+
+// applyOverrides adjusts scored priorities with the overrides of each
+// nodepool, dropping excluded ones. It runs every reconcile, so the applied
+// overrides are only logged at debug level, the API serves them.
+func applyOverrides(nodePools NodepoolMap, scores map[string]int) map[string]int {
+	keys := make([]string, 0, len(scores))
+	for key := range scores {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make(map[string]int, len(scores))
+	for _, key := range keys {
+		np := nodePools[key]
+		priority, ok := np.Overrides.apply(scores[key])
+		if np.Overrides != nil {
+			lg.Debugf("applying overrides to nodepool %s (%s): %d -> %d", np.Name, np.Overrides, scores[key], priority)
+		}
+		if !ok {
+			continue
+		}
+		result[key] = priority
+	}
+	return result
+}
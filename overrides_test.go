@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOverrideTags(t *testing.T) {
+	tag := func(value string) *string { return &value }
+
+	overrides, err := parseOverrideTags(map[string]*string{"team": tag("platform")})
+	assert.NoError(t, err)
+	assert.Nil(t, overrides)
+
+	overrides, err = parseOverrideTags(map[string]*string{
+		excludeTag:    tag("false"),
+		priorityTag:   tag("90"),
+		weightBiasTag: tag("+10"),
+	})
+	require.NoError(t, err)
+	assert.False(t, overrides.Exclude)
+	assert.Equal(t, 90, *overrides.Priority)
+	assert.Equal(t, 10, overrides.WeightBias)
+	assert.Equal(t, "tags", overrides.Source)
+
+	overrides, err = parseOverrideTags(map[string]*string{
+		excludeTag:    tag("yes"),
+		weightBiasTag: tag("-5"),
+	})
+	assert.Error(t, err)
+	assert.Equal(t, -5, overrides.WeightBias)
+}
+
+func TestApplyConfigOverrides(t *testing.T) {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	require.NoError(t, cfg.ReadConfig(strings.NewReader(`
+overrides:
+  spota:
+    weightBias: -5
+  aks-a/spotb:
+    exclude: true
+  spotb:
+    priority: 50
+`)))
+
+	pinned := 90
+	instances := map[string][]AgentPool{
+		"Standard_D4s_v5": {
+			{Name: "spota"},
+			{Name: "spotb"},
+			{Name: "spotc", Overrides: &NodepoolOverrides{Priority: &pinned, Source: "tags"}},
+			{Name: "spotd"},
+		},
+	}
+	require.NoError(t, applyConfigOverrides(cfg, "aks-a", instances))
+
+	pools := instances["Standard_D4s_v5"]
+	assert.Equal(t, &NodepoolOverrides{WeightBias: -5, Source: "config"}, pools[0].Overrides)
+	assert.Equal(t, &NodepoolOverrides{Exclude: true, Source: "config"}, pools[1].Overrides)
+	assert.Equal(t, "tags", pools[2].Overrides.Source)
+	assert.Nil(t, pools[3].Overrides)
+}
+
+func TestCalculatePriorityWithOverrides(t *testing.T) {
+	pinned := 90
+	nodePools := NodepoolMap{
+		"spota": {Name: "spota", Discount: 0.9, EvictionRate: 0.05, Version: 2},
+		"spotb": {Name: "spotb", Discount: 0.9, EvictionRate: 0.05, Version: 2, Overrides: &NodepoolOverrides{WeightBias: 10}},
+		"spotc": {Name: "spotc", Discount: 0.9, EvictionRate: 0.05, Version: 2, Overrides: &NodepoolOverrides{Priority: &pinned}},
+		"spotd": {Name: "spotd", Discount: 0.9, EvictionRate: 0.05, Version: 2, Overrides: &NodepoolOverrides{Exclude: true}},
+	}
+
+	priorities := calculatePriority(nodePools, weightedScorer{weights: scoringPresets["weighted"]})
+	assert.Equal(t, map[int][]string{
+		30: {"^aks-spota-[0-9]+-vmss$"},
+		40: {"^aks-spotb-[0-9]+-vmss$"},
+		90: {"^aks-spotc-[0-9]+-vmss$"},
+	}, priorities)
+}
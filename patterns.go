@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultPatternTemplate matches the VMSS backing an AKS nodepool, which is
+// the node group name seen by the cluster-autoscaler.
+const defaultPatternTemplate = "^aks-{{.Name}}-[0-9]+-vmss$"
+
+var activePatternTemplate = struct {
+	sync.RWMutex
+	template *template.Template
+}{
+	template: template.Must(template.New("pattern").Parse(defaultPatternTemplate)),
+}
+
+// newPatternTemplate parses a node group pattern template and checks that it
+// renders a valid regular expression.
+func newPatternTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("pattern").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern template %q: %w", text, err)
+	}
+	pattern, err := renderPattern(tmpl, "nodepool")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern template %q: %w", text, err)
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("pattern template %q renders an invalid regular expression: %w", text, err)
+	}
+	return tmpl, nil
+}
+
+func renderPattern(tmpl *template.Template, name string) (string, error) {
+	var b strings.Builder
+	err := tmpl.Execute(&b, struct{ Name string }{regexp.QuoteMeta(strings.TrimSpace(name))})
+	return b.String(), err
+}
+
+// reloadPatternTemplate swaps in pattern.template from the current config. On
+// error the previous template is kept.
+func reloadPatternTemplate(cfg *viper.Viper) error {
+	tmpl, err := newPatternTemplate(cfg.GetString("pattern.template"))
+	if err != nil {
+		return err
+	}
+	activePatternTemplate.Lock()
+	activePatternTemplate.template = tmpl
+	activePatternTemplate.Unlock()
+	return nil
+}
+
+// nodeGroupPattern renders the priority expander pattern of a nodepool.
+func nodeGroupPattern(name string) string {
+	activePatternTemplate.RLock()
+	defer activePatternTemplate.RUnlock()
+	// Templates are validated when loaded, rendering cannot fail
+	pattern, _ := renderPattern(activePatternTemplate.template, name)
+	return pattern
+}
+
+var vmssProviderID = regexp.MustCompile(`(?i)/virtualMachineScaleSets/([^/]+)/`)
+
+// checkNodeGroupPatterns matches the pattern of every nodepool found on nodes
+// against the VMSS node groups of the nodes and reports patterns that match
+// no node group, or node groups of other nodepools.
+func checkNodeGroupPatterns(nodes []corev1.Node, nodepoolLabel string) []string {
+	groupPools := make(map[string]string)
+	for _, node := range nodes {
+		pool, ok := node.Labels[nodepoolLabel]
+		if !ok {
+			continue
+		}
+		if match := vmssProviderID.FindStringSubmatch(node.Spec.ProviderID); match != nil {
+			groupPools[match[1]] = pool
+		}
+	}
+
+	pools := make(map[string]bool)
+	for _, pool := range groupPools {
+		pools[pool] = true
+	}
+	names := make([]string, 0, len(pools))
+	for pool := range pools {
+		names = append(names, pool)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, pool := range names {
+		pattern := nodeGroupPattern(pool)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("pattern %s of nodepool %s is invalid: %s", pattern, pool, err))
+			continue
+		}
+
+		matched := make(map[string]bool)
+		for group, groupPool := range groupPools {
+			if re.MatchString(group) {
+				matched[groupPool] = true
+			}
+		}
+
+		if len(matched) == 0 {
+			problems = append(problems, fmt.Sprintf("pattern %s of nodepool %s matches no node group", pattern, pool))
+		} else if len(matched) > 1 {
+			others := make([]string, 0, len(matched))
+			for other := range matched {
+				if other != pool {
+					others = append(others, other)
+				}
+			}
+			sort.Strings(others)
+			problems = append(problems, fmt.Sprintf("pattern %s of nodepool %s also matches nodepools %s", pattern, pool, strings.Join(others, ", ")))
+		}
+	}
+
+	return problems
+}
+
+// validateNodeGroupPatterns logs the pattern problems of every cluster. It
+// only warns, the nodepools may not have any nodes yet.
+func validateNodeGroupPatterns(ctx context.Context, cfg *viper.Viper, clusters []ClusterConfig) {
+	for _, cluster := range clusters {
+		clientset, err := getK8SClientFor(cluster.Kubeconfig, cluster.Context)
+		if err != nil {
+			lg.WithError(err).Warnf("Failed to validate node group patterns of cluster %s", cluster.Name)
+			continue
+		}
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			lg.WithError(err).Warnf("Failed to validate node group patterns of cluster %s", cluster.Name)
+			continue
+		}
+		for _, problem := range checkNodeGroupPatterns(nodes.Items, cfg.GetString("label.nodepool")) {
+			lg.Warnf("Cluster %s: %s", cluster.Name, problem)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeGroupPattern(t *testing.T) {
+	assert.Equal(t, "^aks-spota-[0-9]+-vmss$", nodeGroupPattern(" spota "))
+
+	_, err := newPatternTemplate("{{.Name")
+	assert.Error(t, err)
+	_, err = newPatternTemplate("{{.Pool}}")
+	assert.Error(t, err)
+	_, err = newPatternTemplate("^aks-{{.Name}}-[0-9+-vmss$")
+	assert.Error(t, err)
+
+	cfg := viper.New()
+	cfg.Set("pattern.template", "^{{.Name}}$")
+	assert.NoError(t, reloadPatternTemplate(cfg))
+	defer func() {
+		cfg.Set("pattern.template", defaultPatternTemplate)
+		assert.NoError(t, reloadPatternTemplate(cfg))
+	}()
+	assert.Equal(t, "^spota$", nodeGroupPattern("spota"))
+
+	cfg.Set("pattern.template", "{{")
+	assert.Error(t, reloadPatternTemplate(cfg))
+	assert.Equal(t, "^spota$", nodeGroupPattern("spota"))
+}
+
+func TestCheckNodeGroupPatterns(t *testing.T) {
+	node := func(name, pool, vmss string) corev1.Node {
+		return corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"agentpool": pool}},
+			Spec: corev1.NodeSpec{
+				ProviderID: "azure:///subscriptions/sub/resourceGroups/mc_rg/providers/Microsoft.Compute/virtualMachineScaleSets/" + vmss + "/virtualMachines/0",
+			},
+		}
+	}
+	nodes := []corev1.Node{
+		node("aks-spot-1-vmss000000", "spot", "aks-spot-1-vmss"),
+		node("aks-spotgpu-2-vmss000000", "spotgpu", "aks-spotgpu-2-vmss"),
+		node("custom-vmss000000", "custom", "custom-vmss"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	}
+
+	assert.Equal(t, []string{
+		"pattern ^aks-custom-[0-9]+-vmss$ of nodepool custom matches no node group",
+	}, checkNodeGroupPatterns(nodes, "agentpool"))
+
+	cfg := viper.New()
+	cfg.Set("pattern.template", ".*{{.Name}}.*")
+	assert.NoError(t, reloadPatternTemplate(cfg))
+	defer func() {
+		cfg.Set("pattern.template", defaultPatternTemplate)
+		assert.NoError(t, reloadPatternTemplate(cfg))
+	}()
+	assert.Equal(t, []string{
+		"pattern .*spot.* of nodepool spot also matches nodepools spotgpu",
+	}, checkNodeGroupPatterns(nodes, "agentpool"))
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// minPlacementCacheTTL is the minimum time placement scores should be cached
+// for according to the Azure docs.
+const minPlacementCacheTTL = 15 * time.Minute
+
+const placementCacheConfigMapKey = "placement-scores.json"
+
+type placementCacheEntry struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Scores    map[string]int `json:"scores"`
+}
+
+// placementCacheStore persists the placement score cache across restarts.
+type placementCacheStore interface {
+	Load(ctx context.Context) (map[string]placementCacheEntry, error)
+	Save(ctx context.Context, data map[string]placementCacheEntry) error
+}
+
+// PlacementScoreCache holds placement scores per subscription, region and
+// SKU, each entry with the scores of every zone of the SKU. Entries are not
+// split per zone as the API always returns every zone of a SKU at once.
+type PlacementScoreCache struct {
+	mu    sync.Mutex
+	data  map[string]placementCacheEntry
+	ttl   time.Duration
+	store placementCacheStore
+}
+
+var placementCache = &PlacementScoreCache{
+	data: make(map[string]placementCacheEntry),
+	ttl:  minPlacementCacheTTL,
+}
+
+// placementCacheKey keys the cache by subscription as placement scores
+// depend on its quotas and capacity.
+func placementCacheKey(subscription, region, instance string) string {
+	return strings.ToLower(subscription + "/" + region + "/" + instance)
+}
+
+func (c *PlacementScoreCache) get(subscription, region, instance string) (map[string]int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.data[placementCacheKey(subscription, region, instance)]
+	if !ok || time.Since(entry.Timestamp) >= c.ttl {
+		return nil, false
+	}
+	return entry.Scores, true
+}
+
+func (c *PlacementScoreCache) set(subscription, region, instance string, scores map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[placementCacheKey(subscription, region, instance)] = placementCacheEntry{Timestamp: time.Now(), Scores: scores}
+}
+
+// fetchedAt returns when the oldest cached scores of the instances were
+// fetched, or the zero time when any of them is missing or expired.
+func (c *PlacementScoreCache) fetchedAt(subscription, region string, instances []string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest time.Time
+	for _, instance := range instances {
+		entry, ok := c.data[placementCacheKey(subscription, region, instance)]
+		if !ok || time.Since(entry.Timestamp) >= c.ttl {
+			return time.Time{}
+		}
+		if oldest.IsZero() || entry.Timestamp.Before(oldest) {
+			oldest = entry.Timestamp
+		}
+	}
+	return oldest
+}
+
+// load fills the cache from its store, skipping expired entries.
+func (c *PlacementScoreCache) load(ctx context.Context) error {
+	if c.store == nil {
+		return nil
+	}
+	data, err := c.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range data {
+		if time.Since(entry.Timestamp) < c.ttl {
+			c.data[key] = entry
+		}
+	}
+	lg.Infof("loaded %d placement scores from cache store", len(c.data))
+	return nil
+}
+
+func (c *PlacementScoreCache) persist(ctx context.Context) {
+	if c.store == nil {
+		return
+	}
+
+	c.mu.Lock()
+	data := make(map[string]placementCacheEntry, len(c.data))
+	for key, entry := range c.data {
+		if time.Since(entry.Timestamp) < c.ttl {
+			data[key] = entry
+		}
+	}
+	c.mu.Unlock()
+
+	if err := c.store.Save(ctx, data); err != nil {
+		lg.WithError(err).Warn("failed to persist placement score cache")
+	}
+}
+
+type filePlacementCacheStore struct {
+	path string
+}
+
+func (s filePlacementCacheStore) Load(_ context.Context) (map[string]placementCacheEntry, error) {
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]placementCacheEntry
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s filePlacementCacheStore) Save(_ context.Context, data map[string]placementCacheEntry) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves a
+// truncated file behind. Missing parent directories are created.
+func writeFileAtomic(path string, raw []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type configMapPlacementCacheStore struct {
+	name      string
+	namespace string
+}
+
+func (s configMapPlacementCacheStore) Load(ctx context.Context) (map[string]placementCacheEntry, error) {
+	clientset, err := getK8SClient()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]placementCacheEntry
+	if raw := cm.Data[placementCacheConfigMapKey]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (s configMapPlacementCacheStore) Save(ctx context.Context, data map[string]placementCacheEntry) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	clientset, err := getK8SClient()
+	if err != nil {
+		return err
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.namespace,
+			},
+			Data: map[string]string{placementCacheConfigMapKey: string(raw)},
+		}
+		_, err = clientset.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[placementCacheConfigMapKey] = string(raw)
+	_, err = clientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// setupPlacementCache configures the cache TTL and its optional store
+// (placement.cache.persist: file or configmap) and loads persisted scores.
+func setupPlacementCache(ctx context.Context, cfg *viper.Viper) {
+	ttl := cfg.GetDuration("placement.cache.ttl")
+	if ttl < minPlacementCacheTTL {
+		lg.Warnf("placement.cache.ttl %s is below the minimum of %s", ttl, minPlacementCacheTTL)
+		ttl = minPlacementCacheTTL
+	}
+
+	var store placementCacheStore
+	switch persist := cfg.GetString("placement.cache.persist"); persist {
+	case "":
+	case "file":
+		store = filePlacementCacheStore{path: cfg.GetString("placement.cache.file")}
+	case "configmap":
+		store = configMapPlacementCacheStore{
+			name:      cfg.GetString("placement.cache.configmap.name"),
+			namespace: cfg.GetString("placement.cache.configmap.namespace"),
+		}
+	default:
+		lg.Warnf("unknown placement.cache.persist %q, placement scores are not persisted", persist)
+	}
+
+	placementCache.mu.Lock()
+	placementCache.ttl = ttl
+	placementCache.store = store
+	placementCache.mu.Unlock()
+
+	if err := placementCache.load(ctx); err != nil {
+		lg.WithError(err).Warn("failed to load persisted placement scores")
+	}
+}
+
+// cachedPlacementScores returns the placement scores of the shared cache
+// without calling the API, reloading it from its store first. It is used by
+// followers, which must not fetch placement scores themselves. complete
+// reports whether every instance was found.
+func cachedPlacementScores(ctx context.Context, subscription, region string, instances []string) (placementscores map[string]map[string]int, complete bool) {
+	if err := placementCache.load(ctx); err != nil {
+		lg.WithError(err).Warn("failed to load shared placement scores")
+	}
+
+	result := make(map[string]map[string]int)
+	complete = true
+	for _, instance := range instances {
+		scores, ok := placementCache.get(subscription, region, instance)
+		if !ok {
+			complete = false
+			continue
+		}
+		result[instance] = scores
+	}
+	return result, complete
+}
+
+func getPlacementScores(region, subscriptionId string, cred azcore.TokenCredential, instances []string, ctx context.Context) (placementscores map[string]map[string]int, err error) {
+	type skuObj struct {
+		SKU string `json:"sku"`
+	}
+
+	type requestPayload struct {
+		AvailabilityZones string   `json:"availabilityZones"`
+		DesiredCount      string   `json:"desiredCount"`
+		DesiredLocations  []string `json:"desiredLocations"`
+		DesiredSizes      []skuObj `json:"desiredSizes"`
+	}
+
+	scoreMap := map[string]int{
+		"Low":    25,
+		"Medium": 50,
+		"High":   100,
+	}
+
+	result := make(map[string]map[string]int)
+	var missing []string
+	for _, instance := range instances {
+		if scores, ok := placementCache.get(subscriptionId, region, instance); ok {
+			result[instance] = scores
+			continue
+		}
+		missing = append(missing, instance)
+	}
+
+	if len(missing) == 0 {
+		lg.Info("returning placement scores from cache")
+		return result, nil
+	}
+
+	// Get access token for ARM
+	scope := "https://management.azure.com/.default"
+	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{scope},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+
+	placementApiUrl := fmt.Sprintf(
+		"https://management.azure.com/subscriptions/%s/providers/Microsoft.Compute/locations/%s/placementScores/spot/generate?api-version=2025-02-01-preview",
+		subscriptionId,
+		region,
+	)
+
+	// Persist whatever was fetched, even when a later chunk fails
+	defer placementCache.persist(ctx)
+
+	// Break instances into chunks of 5
+	for i := 0; i < len(missing); i += 5 {
+		end := min(i+5, len(missing))
+		chunk := missing[i:end]
+
+		var sizes []skuObj
+		for _, sku := range chunk {
+			sizes = append(sizes, skuObj{SKU: sku})
+		}
+
+		payload := requestPayload{
+			AvailabilityZones: "true",
+			DesiredCount:      "1",
+			DesiredLocations:  []string{region},
+			DesiredSizes:      sizes,
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request payload: %w", err)
+		}
+
+		parsed, err := postPlacementScores(ctx, placementApiUrl, token.Token, body)
+		if err != nil {
+			return nil, err
+		}
+		lg.Infof("fetching placementscore chunk %v was successful", chunk)
+
+		fetched := make(map[string]map[string]int)
+		for _, ps := range parsed.PlacementScores {
+			key := regionSKUKey(region, ps.SKU)
+			if _, ok := fetched[key]; !ok {
+				fetched[key] = make(map[string]int)
+			}
+			fetched[key][ps.AvailabilityZone] = scoreMap[ps.Score]
+		}
+		for _, instance := range chunk {
+			scores := fetched[regionSKUKey(region, instance)]
+			if scores == nil {
+				scores = make(map[string]int)
+			}
+			placementCache.set(subscriptionId, region, instance, scores)
+			result[instance] = scores
+		}
+	}
+
+	lg.Info("placement scores calculated and cached", "result", result)
+
+	return result, nil
+}
+
+type placementResponse struct {
+	PlacementScores []struct {
+		SKU              string `json:"sku"`
+		AvailabilityZone string `json:"availabilityZone"`
+		Score            string `json:"score"`
+	} `json:"placementScores"`
+}
+
+// postPlacementScores sends a placement score request, backing off on 429
+// Too Many Requests.
+func postPlacementScores(ctx context.Context, placementApiUrl, token string, body []byte) (*placementResponse, error) {
+	var resp *http.Response
+	maxRetries := 3
+	retryDelay := time.Minute
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", placementApiUrl, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < maxRetries-1 {
+			// Backoff and retry
+			lg.Warnf("Received 429 Too Many Requests. Retrying in %s...", retryDelay)
+			resp.Body.Close()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(retryDelay):
+			}
+			retryDelay *= 4 // Exponential backoff
+			continue
+		}
+
+		// Break out if it's not a 429
+		break
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, &apiError{api: "placement score", statusCode: resp.StatusCode, status: resp.Status}
+	}
+
+	var parsed placementResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &parsed, nil
+}
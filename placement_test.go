@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlacementScoreCacheExpiry(t *testing.T) {
+	cache := &PlacementScoreCache{data: make(map[string]placementCacheEntry), ttl: minPlacementCacheTTL}
+
+	cache.set("sub-a", "eastus", "Standard_D4s_v5", map[string]int{"1": 100, "2": 50})
+	scores, ok := cache.get("SUB-A", "EastUS", "standard_d4s_v5")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int{"1": 100, "2": 50}, scores)
+
+	// Placement scores of another subscription are not shared
+	_, ok = cache.get("sub-b", "eastus", "Standard_D4s_v5")
+	assert.False(t, ok)
+
+	cache.data[placementCacheKey("sub-a", "eastus", "Standard_D4s_v5")] = placementCacheEntry{
+		Timestamp: time.Now().Add(-minPlacementCacheTTL),
+		Scores:    scores,
+	}
+	_, ok = cache.get("sub-a", "eastus", "Standard_D4s_v5")
+	assert.False(t, ok)
+}
+
+func TestPlacementScoreCacheFileStore(t *testing.T) {
+	// The cache directory is created on the first save
+	store := filePlacementCacheStore{path: filepath.Join(t.TempDir(), "spot-monitor", "placement-scores.json")}
+
+	data, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	cache := &PlacementScoreCache{data: make(map[string]placementCacheEntry), ttl: minPlacementCacheTTL, store: store}
+	cache.set("sub-a", "eastus", "Standard_D4s_v5", map[string]int{"1": 100})
+	cache.set("sub-a", "eastus", "Standard_E4s_v5", map[string]int{})
+	cache.data[placementCacheKey("sub-a", "westus", "Standard_D4s_v5")] = placementCacheEntry{
+		Timestamp: time.Now().Add(-time.Hour),
+		Scores:    map[string]int{"1": 25},
+	}
+	cache.persist(context.Background())
+
+	restored := &PlacementScoreCache{data: make(map[string]placementCacheEntry), ttl: minPlacementCacheTTL, store: store}
+	require.NoError(t, restored.load(context.Background()))
+	assert.Len(t, restored.data, 2)
+
+	scores, ok := restored.get("sub-a", "eastus", "Standard_D4s_v5")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int{"1": 100}, scores)
+	_, ok = restored.get("sub-a", "eastus", "Standard_E4s_v5")
+	assert.True(t, ok)
+	_, ok = restored.get("sub-a", "westus", "Standard_D4s_v5")
+	assert.False(t, ok)
+}
+
+func TestSetupPlacementCacheMinimumTTL(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("placement.cache.ttl", "1m")
+	setupPlacementCache(context.Background(), cfg)
+	assert.Equal(t, minPlacementCacheTTL, placementCache.ttl)
+	assert.Nil(t, placementCache.store)
+}
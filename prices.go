@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// pricesBatchSize bounds the number of SKUs combined into a single $filter to
+// keep request URLs at a reasonable length.
+const pricesBatchSize = 10
+
+type Item struct {
+	CurrencyCode    string            `json:"currencyCode"`
+	RetailPrice     float64           `json:"retailPrice"`
+	ArmSKUName      string            `json:"armSkuName"`
+	ArmRegionName   string            `json:"armRegionName"`
+	SKUName         string            `json:"skuName"`
+	ProductName     string            `json:"productName"`
+	Type            string            `json:"type"`
+	ReservationTerm string            `json:"reservationTerm"`
+	SavingsPlan     []SavingsPlanItem `json:"savingsPlan"`
+}
+
+// SavingsPlanItem is the hourly savings plan price of a Consumption item.
+type SavingsPlanItem struct {
+	RetailPrice float64 `json:"retailPrice"`
+	Term        string  `json:"term"`
+}
+
+type Response struct {
+	Items        []Item `json:"Items"`
+	NextPageLink string `json:"NextPageLink"`
+}
+
+// Prices are hourly prices. Reserved and savings plan prices are only set when
+// requested with pricing.baseline, pricing.reservations.enabled or
+// pricing.savingsplans.enabled.
+type Prices struct {
+	Regular       float64
+	Spot          float64
+	Reserved1Y    float64
+	Reserved3Y    float64
+	SavingsPlan1Y float64
+	SavingsPlan3Y float64
+	Currency      string
+}
+
+// Price baselines spot prices are compared against.
+const (
+	baselineConsumption   = "consumption"
+	baselineReservation1Y = "reservation-1y"
+	baselineReservation3Y = "reservation-3y"
+	baselineSavingsPlan1Y = "savings-plan-1y"
+	baselineSavingsPlan3Y = "savings-plan-3y"
+)
+
+// Baseline returns the hourly price of the given baseline. It falls back to
+// the pay-as-you-go price when the SKU has no such price.
+func (p Prices) Baseline(baseline string) (price float64, ok bool) {
+	switch baseline {
+	case baselineReservation1Y:
+		price = p.Reserved1Y
+	case baselineReservation3Y:
+		price = p.Reserved3Y
+	case baselineSavingsPlan1Y:
+		price = p.SavingsPlan1Y
+	case baselineSavingsPlan3Y:
+		price = p.SavingsPlan3Y
+	default:
+		return p.Regular, true
+	}
+	if price == 0 {
+		return p.Regular, false
+	}
+	return price, true
+}
+
+// priceWarnings remembers the SKUs already warned about a missing price, so
+// that a price missing for good is not reported on every reconcile.
+type priceWarnings struct {
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+var missingPrices = &priceWarnings{warned: make(map[string]bool)}
+
+// missing logs the warning the first time key is missing.
+func (w *priceWarnings) missing(key, format string, args ...interface{}) {
+	w.mu.Lock()
+	warned := w.warned[key]
+	w.warned[key] = true
+	w.mu.Unlock()
+	if warned {
+		lg.Debugf(format, args...)
+		return
+	}
+	lg.Warnf(format, args...)
+}
+
+// found forgets key, so that it is warned about again if it goes missing.
+func (w *priceWarnings) found(key string) {
+	w.mu.Lock()
+	delete(w.warned, key)
+	w.mu.Unlock()
+}
+
+// spotDiscount returns the discount of the spot price on the baseline price
+// as a fraction. Without both prices there is no discount and ok is false.
+func spotDiscount(baselinePrice, spotPrice float64) (discount float64, ok bool) {
+	if baselinePrice <= 0 || spotPrice <= 0 {
+		return 0, false
+	}
+	return (baselinePrice - spotPrice) / baselinePrice, true
+}
+
+var currencyCodeRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Hours in a reservation term, reservation items are priced for the whole term.
+var reservationTermHours = map[string]float64{
+	"1 Year":  365 * 24,
+	"3 Years": 3 * 365 * 24,
+}
+
+// Operating systems with their own VM meters.
+const (
+	osLinux   = "linux"
+	osWindows = "windows"
+)
+
+// OSPrices holds the prices of an instance type per operating system.
+type OSPrices map[string]Prices
+
+// priceOS returns the meters used by an agent pool OS type, Linux unless it
+// is Windows.
+func priceOS(osType string) string {
+	if strings.EqualFold(osType, "Windows") {
+		return osWindows
+	}
+	return osLinux
+}
+
+type pricesCacheEntry struct {
+	timestamp time.Time
+	prices    OSPrices
+}
+
+// PricesClient fetches VM prices from the Azure Retail Prices API, batching
+// SKUs into as few requests as possible and caching the results per region
+// and SKU.
+type PricesClient struct {
+	baseURL      string
+	currency     string
+	baseline     string
+	reservations bool
+	savingsPlans bool
+	ttl          time.Duration
+	httpClient   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]pricesCacheEntry
+}
+
+func newPricesClient(cfg *viper.Viper) (*PricesClient, error) {
+	baseline := cfg.GetString("pricing.baseline")
+	if baseline == "" {
+		baseline = baselineConsumption
+	}
+	switch baseline {
+	case baselineConsumption, baselineReservation1Y, baselineReservation3Y, baselineSavingsPlan1Y, baselineSavingsPlan3Y:
+	default:
+		return nil, fmt.Errorf("unknown pricing.baseline %q", baseline)
+	}
+
+	currency := strings.ToUpper(cfg.GetString("pricing.currency"))
+	if currency == "" {
+		currency = "USD"
+	}
+	if !currencyCodeRegexp.MatchString(currency) {
+		return nil, fmt.Errorf("invalid pricing.currency %q", currency)
+	}
+
+	return &PricesClient{
+		baseURL:      cfg.GetString("api.url"),
+		currency:     currency,
+		baseline:     baseline,
+		reservations: cfg.GetBool("pricing.reservations.enabled") || strings.HasPrefix(baseline, "reservation"),
+		savingsPlans: cfg.GetBool("pricing.savingsplans.enabled") || strings.HasPrefix(baseline, "savings-plan"),
+		ttl:          cfg.GetDuration("api.cache.ttl"),
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		cache:        make(map[string]pricesCacheEntry),
+	}, nil
+}
+
+func regionSKUKey(region, instance string) string {
+	return strings.ToLower(region + "/" + instance)
+}
+
+// GetPrices returns the Linux and Windows regular and spot prices for every
+// instance, keyed by instance type. Only instances missing from the cache are
+// requested.
+func (c *PricesClient) GetPrices(ctx context.Context, region string, instances []string) (map[string]OSPrices, error) {
+	result := make(map[string]OSPrices, len(instances))
+	var missing []string
+
+	c.mu.Lock()
+	for _, instance := range instances {
+		entry, ok := c.cache[regionSKUKey(region, instance)]
+		if ok && time.Since(entry.timestamp) < c.ttl {
+			result[instance] = entry.prices
+			continue
+		}
+		missing = append(missing, instance)
+	}
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		lg.Info("returning prices from cache")
+		return result, nil
+	}
+
+	for i := 0; i < len(missing); i += pricesBatchSize {
+		end := min(i+pricesBatchSize, len(missing))
+		chunk := missing[i:end]
+
+		items, err := c.fetch(ctx, region, chunk)
+		if err != nil {
+			return nil, err
+		}
+		lg.Infof("fetching prices for %v was successful", chunk)
+
+		fetched, err := classifyPrices(items)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		c.mu.Lock()
+		for _, instance := range chunk {
+			prices := fetched[strings.ToLower(instance)]
+			if prices == nil {
+				prices = make(OSPrices)
+			}
+			c.cache[regionSKUKey(region, instance)] = pricesCacheEntry{timestamp: now, prices: prices}
+			result[instance] = prices
+		}
+		c.mu.Unlock()
+	}
+
+	return result, nil
+}
+
+// fetchedAt returns when the oldest cached prices of the instances were
+// fetched, or the zero time when any of them is not cached.
+func (c *PricesClient) fetchedAt(region string, instances []string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest time.Time
+	for _, instance := range instances {
+		entry, ok := c.cache[regionSKUKey(region, instance)]
+		if !ok {
+			return time.Time{}
+		}
+		if oldest.IsZero() || entry.timestamp.Before(oldest) {
+			oldest = entry.timestamp
+		}
+	}
+	return oldest
+}
+
+// fetch runs a single batched query and follows NextPageLink until every page
+// has been read.
+func (c *PricesClient) fetch(ctx context.Context, region string, instances []string) ([]Item, error) {
+	skuFilters := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		skuFilters = append(skuFilters, fmt.Sprintf("armSkuName eq '%s'", instance))
+	}
+	priceTypes := "priceType eq 'Consumption'"
+	if c.reservations {
+		priceTypes = "(priceType eq 'Consumption' or priceType eq 'Reservation')"
+	}
+	urlQuery := fmt.Sprintf("serviceName eq '%s' and %s and armRegionName eq '%s' and (%s)",
+		"Virtual Machines",
+		priceTypes,
+		region,
+		strings.Join(skuFilters, " or "),
+	)
+
+	nextURL := fmt.Sprintf("%s?currencyCode=%s&$filter=%s",
+		c.baseURL,
+		url.QueryEscape("'"+c.currency+"'"),
+		strings.ReplaceAll(url.QueryEscape(urlQuery), "+", "%20"),
+	)
+	// Savings plan prices are only returned by the preview API version
+	if c.savingsPlans {
+		nextURL += "&api-version=2023-01-01-preview"
+	}
+
+	var items []Item
+	for nextURL != "" {
+		page, err := c.fetchPage(ctx, nextURL)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		nextURL = page.NextPageLink
+	}
+
+	return items, nil
+}
+
+func (c *PricesClient) fetchPage(ctx context.Context, pageURL string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			lg.WithError(err).Error("failed to close response body")
+		}
+	}(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return nil, &apiError{api: "retail prices", statusCode: resp.StatusCode, status: resp.Status}
+	}
+
+	var data Response
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// classifyPrices groups price items by lowercased SKU and operating system and
+// splits them into the regular, spot, reserved and savings plan prices.
+// Windows meters are the ones whose product name contains Windows.
+// Reservations only cover compute, Windows reserved prices add the Windows
+// license part of the pay-as-you-go price to the Linux reserved price. All
+// prices of a SKU and operating system must share a currency.
+func classifyPrices(items []Item) (map[string]OSPrices, error) {
+	prices := make(map[string]OSPrices)
+
+	for _, item := range items {
+		key := strings.ToLower(item.ArmSKUName)
+		if prices[key] == nil {
+			prices[key] = make(OSPrices)
+		}
+		os := osLinux
+		if strings.Contains(item.ProductName, "Windows") {
+			os = osWindows
+		}
+		p := prices[key][os]
+		if item.Type == "Reservation" {
+			hours, ok := reservationTermHours[item.ReservationTerm]
+			if !ok {
+				continue
+			}
+			switch item.ReservationTerm {
+			case "1 Year":
+				p.Reserved1Y = item.RetailPrice / hours
+			case "3 Years":
+				p.Reserved3Y = item.RetailPrice / hours
+			}
+		} else if strings.Contains(item.SKUName, "Spot") {
+			p.Spot = item.RetailPrice
+		} else if strings.Contains(item.SKUName, "Low Priority") {
+			// Skip low priority items
+			continue
+		} else {
+			p.Regular = item.RetailPrice
+			for _, plan := range item.SavingsPlan {
+				switch plan.Term {
+				case "1 Year":
+					p.SavingsPlan1Y = plan.RetailPrice
+				case "3 Years":
+					p.SavingsPlan3Y = plan.RetailPrice
+				}
+			}
+		}
+		if p.Currency != "" && p.Currency != item.CurrencyCode {
+			return nil, fmt.Errorf("%s (%s) is priced in both %s and %s", item.ArmSKUName, os, p.Currency, item.CurrencyCode)
+		}
+		p.Currency = item.CurrencyCode
+		prices[key][os] = p
+	}
+
+	for _, skuPrices := range prices {
+		linux, windows := skuPrices[osLinux], skuPrices[osWindows]
+		if windows.Regular == 0 || windows.Reserved1Y+windows.Reserved3Y > 0 {
+			continue
+		}
+		license := windows.Regular - linux.Regular
+		if linux.Reserved1Y > 0 {
+			windows.Reserved1Y = linux.Reserved1Y + license
+		}
+		if linux.Reserved3Y > 0 {
+			windows.Reserved3Y = linux.Reserved3Y + license
+		}
+		skuPrices[osWindows] = windows
+	}
+
+	return prices, nil
+}
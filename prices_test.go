@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPricesClient(t *testing.T) {
+	var requests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		filter := r.URL.Query().Get("$filter")
+		assert.Contains(t, filter, "armSkuName eq 'Standard_D4s_v5' or armSkuName eq 'Standard_E8s_v5'")
+		assert.Equal(t, "'USD'", r.URL.Query().Get("currencyCode"))
+
+		resp := Response{}
+		if r.URL.Query().Get("page") == "" {
+			resp.Items = []Item{
+				{CurrencyCode: "USD", RetailPrice: 0.2, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series"},
+				{CurrencyCode: "USD", RetailPrice: 0.04, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5 Spot", ProductName: "Virtual Machines Dsv5 Series"},
+				{CurrencyCode: "USD", RetailPrice: 0.3, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series Windows"},
+				{CurrencyCode: "USD", RetailPrice: 0.12, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5 Spot", ProductName: "Virtual Machines Dsv5 Series Windows"},
+			}
+			resp.NextPageLink = server.URL + "?" + r.URL.RawQuery + "&page=2"
+		} else {
+			resp.Items = []Item{
+				{CurrencyCode: "USD", RetailPrice: 0.5, ArmSKUName: "Standard_E8s_v5", SKUName: "E8s v5", ProductName: "Virtual Machines Esv5 Series"},
+				{CurrencyCode: "USD", RetailPrice: 0.1, ArmSKUName: "Standard_E8s_v5", SKUName: "E8s v5 Spot", ProductName: "Virtual Machines Esv5 Series"},
+				{CurrencyCode: "USD", RetailPrice: 0.4, ArmSKUName: "Standard_E8s_v5", SKUName: "E8s v5 Low Priority", ProductName: "Virtual Machines Esv5 Series"},
+			}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer server.Close()
+
+	cfg := viper.New()
+	cfg.Set("api.url", server.URL)
+	cfg.Set("api.cache.ttl", "1h")
+	client, err := newPricesClient(cfg)
+	assert.NoError(t, err)
+
+	instances := []string{"Standard_D4s_v5", "Standard_E8s_v5"}
+	prices, err := client.GetPrices(context.Background(), "eastus", instances)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]OSPrices{
+		"Standard_D4s_v5": {
+			osLinux:   {Regular: 0.2, Spot: 0.04, Currency: "USD"},
+			osWindows: {Regular: 0.3, Spot: 0.12, Currency: "USD"},
+		},
+		"Standard_E8s_v5": {
+			osLinux: {Regular: 0.5, Spot: 0.1, Currency: "USD"},
+		},
+	}, prices)
+	assert.EqualValues(t, 2, requests.Load())
+	fetchedAt := client.fetchedAt("eastus", instances)
+	assert.False(t, fetchedAt.IsZero())
+
+	// A second call within the TTL is served from the cache, the data keeps
+	// its fetch time
+	cached, err := client.GetPrices(context.Background(), "eastus", instances)
+	assert.NoError(t, err)
+	assert.Equal(t, prices, cached)
+	assert.EqualValues(t, 2, requests.Load())
+	assert.Equal(t, fetchedAt, client.fetchedAt("eastus", instances))
+	assert.True(t, client.fetchedAt("eastus", []string{"Standard_F2s_v2"}).IsZero())
+}
+
+func TestPricesClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "throttled", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	cfg := viper.New()
+	cfg.Set("api.url", server.URL)
+	client, err := newPricesClient(cfg)
+	assert.NoError(t, err)
+
+	_, err = client.GetPrices(context.Background(), "eastus", []string{"Standard_D4s_v5"})
+	assert.Error(t, err)
+}
+
+func TestPriceOS(t *testing.T) {
+	assert.Equal(t, osLinux, priceOS("Linux"))
+	assert.Equal(t, osLinux, priceOS(""))
+	assert.Equal(t, osWindows, priceOS("Windows"))
+}
+
+func TestPricesClientReservations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.URL.Query().Get("$filter"), "(priceType eq 'Consumption' or priceType eq 'Reservation')")
+		assert.Empty(t, r.URL.Query().Get("api-version"))
+
+		assert.NoError(t, json.NewEncoder(w).Encode(Response{Items: []Item{
+			{CurrencyCode: "USD", RetailPrice: 0.2, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series", Type: "Consumption"},
+			{CurrencyCode: "USD", RetailPrice: 0.3, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series Windows", Type: "Consumption"},
+			{CurrencyCode: "USD", RetailPrice: 0.04, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5 Spot", ProductName: "Virtual Machines Dsv5 Series", Type: "Consumption"},
+			{CurrencyCode: "USD", RetailPrice: 876, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series", Type: "Reservation", ReservationTerm: "1 Year"},
+			{CurrencyCode: "USD", RetailPrice: 1314, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series", Type: "Reservation", ReservationTerm: "3 Years"},
+		}}))
+	}))
+	defer server.Close()
+
+	cfg := viper.New()
+	cfg.Set("api.url", server.URL)
+	cfg.Set("pricing.baseline", baselineReservation3Y)
+	client, err := newPricesClient(cfg)
+	assert.NoError(t, err)
+
+	prices, err := client.GetPrices(context.Background(), "eastus", []string{"Standard_D4s_v5"})
+	assert.NoError(t, err)
+
+	linux := prices["Standard_D4s_v5"][osLinux]
+	assert.InDelta(t, 0.1, linux.Reserved1Y, 1e-9)
+	assert.InDelta(t, 0.05, linux.Reserved3Y, 1e-9)
+	baseline, ok := linux.Baseline(client.baseline)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.05, baseline, 1e-9)
+
+	// Windows reservations add the license part of the pay-as-you-go price
+	windows := prices["Standard_D4s_v5"][osWindows]
+	assert.InDelta(t, 0.2, windows.Reserved1Y, 1e-9)
+	assert.InDelta(t, 0.15, windows.Reserved3Y, 1e-9)
+
+	// Without a savings plan price the pay-as-you-go price is used
+	baseline, ok = linux.Baseline(baselineSavingsPlan1Y)
+	assert.False(t, ok)
+	assert.Equal(t, 0.2, baseline)
+
+	cfg.Set("pricing.baseline", "committed")
+	_, err = newPricesClient(cfg)
+	assert.Error(t, err)
+}
+
+func TestClassifySavingsPlanPrices(t *testing.T) {
+	prices, err := classifyPrices([]Item{{
+		CurrencyCode: "USD", RetailPrice: 0.2, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series", Type: "Consumption",
+		SavingsPlan: []SavingsPlanItem{{RetailPrice: 0.14, Term: "1 Year"}, {RetailPrice: 0.1, Term: "3 Years"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, Prices{Regular: 0.2, SavingsPlan1Y: 0.14, SavingsPlan3Y: 0.1, Currency: "USD"}, prices["standard_d4s_v5"][osLinux])
+}
+
+func TestPricesCurrency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "'EUR'", r.URL.Query().Get("currencyCode"))
+		assert.NoError(t, json.NewEncoder(w).Encode(Response{Items: []Item{
+			{CurrencyCode: "EUR", RetailPrice: 0.18, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series"},
+			{CurrencyCode: "EUR", RetailPrice: 0.03, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5 Spot", ProductName: "Virtual Machines Dsv5 Series"},
+		}}))
+	}))
+	defer server.Close()
+
+	cfg := viper.New()
+	cfg.Set("api.url", server.URL)
+	cfg.Set("pricing.currency", "eur")
+	client, err := newPricesClient(cfg)
+	assert.NoError(t, err)
+
+	prices, err := client.GetPrices(context.Background(), "westeurope", []string{"Standard_D4s_v5"})
+	assert.NoError(t, err)
+	assert.Equal(t, Prices{Regular: 0.18, Spot: 0.03, Currency: "EUR"}, prices["Standard_D4s_v5"][osLinux])
+
+	_, err = classifyPrices([]Item{
+		{CurrencyCode: "EUR", RetailPrice: 0.18, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series"},
+		{CurrencyCode: "USD", RetailPrice: 0.04, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5 Spot", ProductName: "Virtual Machines Dsv5 Series"},
+	})
+	assert.Error(t, err)
+
+	cfg.Set("pricing.currency", "euro")
+	_, err = newPricesClient(cfg)
+	assert.Error(t, err)
+}
+
+func TestSpotDiscountWithoutPrices(t *testing.T) {
+	// A SKU without any price item is cached with empty prices
+	prices, err := classifyPrices([]Item{
+		{CurrencyCode: "USD", RetailPrice: 0.2, ArmSKUName: "Standard_D4s_v5", SKUName: "D4s v5", ProductName: "Virtual Machines Dsv5 Series"},
+	})
+	assert.NoError(t, err)
+	missing := prices["standard_e8s_v5"][osLinux]
+
+	discount, ok := spotDiscount(missing.Regular, missing.Spot)
+	assert.False(t, ok)
+	assert.Zero(t, discount)
+	// The status of such a SKU can still be served
+	_, err = json.Marshal(SKUStatus{Instance: "Standard_E8s_v5", Discount: discount})
+	assert.NoError(t, err)
+
+	// No spot price on a priced SKU
+	discount, ok = spotDiscount(prices["standard_d4s_v5"][osLinux].Regular, prices["standard_d4s_v5"][osLinux].Spot)
+	assert.False(t, ok)
+	assert.Zero(t, discount)
+
+	discount, ok = spotDiscount(0.2, 0.05)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.75, discount, 1e-9)
+}
+
+func TestPricesClientSavingsPlans(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2023-01-01-preview", r.URL.Query().Get("api-version"))
+		assert.NoError(t, json.NewEncoder(w).Encode(Response{}))
+	}))
+	defer server.Close()
+
+	cfg := viper.New()
+	cfg.Set("api.url", server.URL)
+	cfg.Set("pricing.savingsplans.enabled", true)
+	client, err := newPricesClient(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, baselineConsumption, client.baseline)
+
+	_, err = client.GetPrices(context.Background(), "eastus", []string{"Standard_D4s_v5"})
+	assert.NoError(t, err)
+}
+
+func TestPriceWarnings(t *testing.T) {
+	w := &priceWarnings{warned: make(map[string]bool)}
+	w.missing("eastus/standard_d4s_v5", "no price")
+	assert.True(t, w.warned["eastus/standard_d4s_v5"])
+
+	w.found("eastus/standard_d4s_v5")
+	assert.Empty(t, w.warned)
+}
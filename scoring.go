@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Scorer assigns a cluster-autoscaler priority to every nodepool, keyed the
+// same way as the NodepoolMap it is given. Higher priorities are preferred.
+type Scorer interface {
+	Score(nodePools NodepoolMap) map[string]int
+}
+
+type ScoringWeights struct {
+	Availability float64
+	Discount     float64
+	Placement    float64
+	Version      float64
+}
+
+// scoringPresets are the built-in weighted strategies. Any weight can be
+// overridden through scoring.weights.<name>.
+var scoringPresets = map[string]ScoringWeights{
+	"weighted":           {Availability: 0.2, Discount: 0.1, Placement: 0.6, Version: 0.1},
+	"cost-first":         {Availability: 0.1, Discount: 0.6, Placement: 0.2, Version: 0.1},
+	"availability-first": {Availability: 0.5, Discount: 0.05, Placement: 0.4, Version: 0.05},
+}
+
+var defaultLexicographicOrder = []string{"placement", "availability", "discount", "version"}
+
+type weightedScorer struct {
+	weights ScoringWeights
+}
+
+func (s weightedScorer) Score(nodePools NodepoolMap) map[string]int {
+	scores := make(map[string]int, len(nodePools))
+	for key, nodePool := range nodePools {
+		// Calculate the components of the discount and placementscore on the priority with placementscore having more weight
+		availabilityRateFactor := (1 - nodePool.EvictionRate) * s.weights.Availability
+		discountFactor := nodePool.Discount * s.weights.Discount
+		placementScoreFactor := float64(nodePool.PlacementScore) / 100 * s.weights.Placement
+		versionFactor := float64(min(10, nodePool.Version)) / 10 * s.weights.Version
+		scores[key] = int((availabilityRateFactor + discountFactor + versionFactor + placementScoreFactor) * 100)
+	}
+	return scores
+}
+
+// lexicographicScorer ranks nodepools by the first field in order, using each
+// following field only to break ties. Pools with identical values share a rank.
+type lexicographicScorer struct {
+	order []string
+}
+
+func (s lexicographicScorer) Score(nodePools NodepoolMap) map[string]int {
+	keys := make([]string, 0, len(nodePools))
+	for key := range nodePools {
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return s.compare(nodePools[keys[i]], nodePools[keys[j]]) < 0
+	})
+
+	scores := make(map[string]int, len(keys))
+	rank := 0
+	for i, key := range keys {
+		if i == 0 || s.compare(nodePools[keys[i-1]], nodePools[key]) != 0 {
+			rank++
+		}
+		scores[key] = rank
+	}
+	return scores
+}
+
+// compare orders a before b when a is the less preferred nodepool.
+func (s lexicographicScorer) compare(a, b Nodepool) int {
+	for _, field := range s.order {
+		av, bv := lexicographicValue(a, field), lexicographicValue(b, field)
+		if av < bv {
+			return -1
+		}
+		if av > bv {
+			return 1
+		}
+	}
+	return 0
+}
+
+func lexicographicValue(np Nodepool, field string) float64 {
+	switch field {
+	case "placement":
+		return float64(np.PlacementScore)
+	case "availability":
+		return 1 - np.EvictionRate
+	case "discount":
+		return np.Discount
+	case "version":
+		return float64(np.Version)
+	}
+	return 0
+}
+
+// scalePenalty converts a penalty in points of the 0-100 weighted scale into
+// one rank step, as a penalty in points would drop a nodepool below all others.
+func (s lexicographicScorer) scalePenalty(points int) int {
+	if points > 0 {
+		return 1
+	}
+	return 0
+}
+
+// penaltyScaler is implemented by Scorers whose priorities are not on the
+// 0-100 scale of the weighted strategies.
+type penaltyScaler interface {
+	scalePenalty(points int) int
+}
+
+// scaledPenalty returns a penalty in points on the scale of scorer.
+func scaledPenalty(scorer Scorer, points int) int {
+	if s, ok := scorer.(penaltyScaler); ok {
+		return s.scalePenalty(points)
+	}
+	return points
+}
+
+// keepPositive shifts every priority up when one fell below 1, keeping their
+// order.
+func keepPositive(scores map[string]int) map[string]int {
+	lowest := 1
+	for _, score := range scores {
+		lowest = min(lowest, score)
+	}
+	if lowest < 1 {
+		for key := range scores {
+			scores[key] += 1 - lowest
+		}
+	}
+	return scores
+}
+
+func newScorer(cfg *viper.Viper) (Scorer, error) {
+	strategy := cfg.GetString("scoring.strategy")
+
+	if strategy == "lexicographic" {
+		order := cfg.GetStringSlice("scoring.order")
+		if len(order) == 0 {
+			order = defaultLexicographicOrder
+		}
+		for _, field := range order {
+			switch field {
+			case "placement", "availability", "discount", "version":
+			default:
+				return nil, fmt.Errorf("unknown scoring.order field %q", field)
+			}
+		}
+		return lexicographicScorer{order: order}, nil
+	}
+
+	weights, ok := scoringPresets[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown scoring strategy %q", strategy)
+	}
+	overrides := map[string]*float64{
+		"availability": &weights.Availability,
+		"discount":     &weights.Discount,
+		"placement":    &weights.Placement,
+		"version":      &weights.Version,
+	}
+	for name, weight := range overrides {
+		if cfg.IsSet("scoring.weights." + name) {
+			*weight = cfg.GetFloat64("scoring.weights." + name)
+		}
+		if *weight < 0 {
+			return nil, fmt.Errorf("scoring weight %s must not be negative", name)
+		}
+	}
+	if weights.Availability+weights.Discount+weights.Placement+weights.Version == 0 {
+		return nil, fmt.Errorf("scoring weights for strategy %q are all zero", strategy)
+	}
+
+	return weightedScorer{weights: weights}, nil
+}
+
+// Regular nodepool placements relative to spot nodepools.
+const (
+	regularLast      = "last"
+	regularThreshold = "threshold"
+	regularScored    = "scored"
+)
+
+// regularPlacementScorer moves the Regular nodepools scored by the wrapped
+// Scorer according to regular.placement:
+//   - last: below every Spot nodepool
+//   - threshold: below the Spot nodepools scoring at least threshold, scaled
+//     like a penalty to the wrapped Scorer, and above all others
+//   - scored: where the wrapped Scorer put them, scored with their discount
+//     against the most expensive Regular nodepool
+//
+// Priorities are shifted up when a placement takes them below 1.
+type regularPlacementScorer struct {
+	Scorer
+	placement string
+	threshold int
+}
+
+func (s regularPlacementScorer) Score(nodePools NodepoolMap) map[string]int {
+	if s.placement == regularScored {
+		return keepPositive(s.Scorer.Score(regularDiscounts(nodePools)))
+	}
+	scores := s.Scorer.Score(nodePools)
+
+	var spotKeys, regularKeys []string
+	for key := range scores {
+		switch nodePools[key].Type {
+		case "Spot":
+			spotKeys = append(spotKeys, key)
+		case "Regular":
+			regularKeys = append(regularKeys, key)
+		}
+	}
+	if len(regularKeys) == 0 || len(spotKeys) == 0 {
+		return scores
+	}
+
+	switch s.placement {
+	case regularLast:
+		lowest := scores[spotKeys[0]]
+		for _, key := range spotKeys[1:] {
+			lowest = min(lowest, scores[key])
+		}
+		for _, key := range regularKeys {
+			scores[key] = min(scores[key], lowest-1)
+		}
+	case regularThreshold:
+		// Free the slot just below the threshold for the regular nodepools
+		for _, key := range spotKeys {
+			if scores[key] < s.threshold {
+				scores[key]--
+			}
+		}
+		for _, key := range regularKeys {
+			scores[key] = s.threshold - 1
+		}
+	}
+
+	return keepPositive(scores)
+}
+
+// regularDiscounts returns a copy of nodePools where Regular nodepools, which
+// pay the on-demand price of their own SKU, get their discount against the
+// most expensive priced Regular nodepool instead, so that cheaper ones rank
+// higher.
+func regularDiscounts(nodePools NodepoolMap) NodepoolMap {
+	highest := 0.0
+	for _, np := range nodePools {
+		if np.Type == "Regular" {
+			highest = max(highest, np.Price)
+		}
+	}
+	if highest <= 0 {
+		return nodePools
+	}
+
+	result := make(NodepoolMap, len(nodePools))
+	for key, np := range nodePools {
+		if np.Type == "Regular" && np.Price > 0 {
+			np.Discount = 1 - np.Price/highest
+		}
+		result[key] = np
+	}
+	return result
+}
+
+func newRegularPlacementScorer(cfg *viper.Viper, scorer Scorer) (Scorer, error) {
+	placement := cfg.GetString("regular.placement")
+	switch placement {
+	case regularLast, regularThreshold, regularScored:
+	default:
+		return nil, fmt.Errorf("unknown regular.placement %q", placement)
+	}
+	return regularPlacementScorer{Scorer: scorer, placement: placement, threshold: scaledPenalty(scorer, cfg.GetInt("regular.threshold"))}, nil
+}
+
+// newScorerChain builds the scorer of a config: the scoring strategy wrapped
+// by the trend, max price and regular placement scorers.
+func newScorerChain(cfg *viper.Viper) (Scorer, error) {
+	scorer, err := newScorer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newRegularPlacementScorer(cfg, newMaxPriceScorer(cfg, newTrendScorer(cfg, scorer)))
+}
+
+// defaultScorer is the scorer of the default config.
+func defaultScorer() Scorer {
+	cfg := viper.New()
+	setDefaults(cfg)
+	scorer, err := newScorerChain(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return scorer
+}
+
+var activeScorer = struct {
+	sync.RWMutex
+	scorer Scorer
+}{
+	scorer: defaultScorer(),
+}
+
+func currentScorer() Scorer {
+	activeScorer.RLock()
+	defer activeScorer.RUnlock()
+	return activeScorer.scorer
+}
+
+// reloadScorer swaps in the scorer described by the current config. On error
+// the previously active scorer is kept.
+func reloadScorer(cfg *viper.Viper) error {
+	scorer, err := newScorerChain(cfg)
+	if err != nil {
+		return err
+	}
+	activeScorer.Lock()
+	activeScorer.scorer = scorer
+	activeScorer.Unlock()
+	lg.Infof("using %s scoring strategy", cfg.GetString("scoring.strategy"))
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// StabilityConfig damps priority flapping caused by noisy inputs:
+//   - Alpha is the EWMA weight of the latest placement score, eviction rate
+//     and discount of a nodepool, 1 disables smoothing
+//   - MinDelta is the smallest priority move applied to a nodepool
+//   - MinDwell is how long an ordering is kept before it can change again,
+//     priority moves that keep the ordering are not held back by it
+type StabilityConfig struct {
+	Alpha    float64
+	MinDelta int
+	MinDwell time.Duration
+}
+
+func newStabilityConfig(cfg *viper.Viper) (StabilityConfig, error) {
+	sc := StabilityConfig{
+		Alpha:    cfg.GetFloat64("smoothing.alpha"),
+		MinDelta: cfg.GetInt("hysteresis.min.delta"),
+		MinDwell: cfg.GetDuration("hysteresis.min.dwell"),
+	}
+	if sc.Alpha <= 0 || sc.Alpha > 1 {
+		return sc, fmt.Errorf("smoothing.alpha must be in (0, 1], got %g", sc.Alpha)
+	}
+	if sc.MinDelta < 0 {
+		return sc, fmt.Errorf("hysteresis.min.delta must not be negative, got %d", sc.MinDelta)
+	}
+	if sc.MinDwell < 0 {
+		return sc, fmt.Errorf("hysteresis.min.dwell must not be negative, got %s", sc.MinDwell)
+	}
+	return sc, nil
+}
+
+type smoothedInputs struct {
+	placementScore float64
+	evictionRate   float64
+	discount       float64
+}
+
+type appliedPriorities struct {
+	priorities map[string]int // by nodepool
+	changedAt  time.Time
+}
+
+// priorityStabilizer keeps the smoothed inputs of every nodepool and the last
+// priorities applied to every cluster.
+type priorityStabilizer struct {
+	mu      sync.Mutex
+	inputs  map[string]map[string]smoothedInputs // by cluster and nodepool
+	applied map[string]appliedPriorities         // by cluster
+}
+
+func newPriorityStabilizer() *priorityStabilizer {
+	return &priorityStabilizer{
+		inputs:  make(map[string]map[string]smoothedInputs),
+		applied: make(map[string]appliedPriorities),
+	}
+}
+
+var stabilizer = newPriorityStabilizer()
+
+// fork copies the state of a cluster into a new stabilizer. Changes made to
+// the fork are kept only when it is committed.
+func (s *priorityStabilizer) fork(cluster string) *priorityStabilizer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := newPriorityStabilizer()
+	if inputs, ok := s.inputs[cluster]; ok {
+		f.inputs[cluster] = maps.Clone(inputs)
+	}
+	if applied, ok := s.applied[cluster]; ok {
+		f.applied[cluster] = appliedPriorities{priorities: maps.Clone(applied.priorities), changedAt: applied.changedAt}
+	}
+	return f
+}
+
+// commit saves the state of a cluster from a fork, once its priorities were
+// written.
+func (s *priorityStabilizer) commit(cluster string, f *priorityStabilizer) {
+	f.mu.Lock()
+	inputs, hasInputs := f.inputs[cluster]
+	applied, hasApplied := f.applied[cluster]
+	f.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hasInputs {
+		s.inputs[cluster] = inputs
+	}
+	if hasApplied {
+		s.applied[cluster] = applied
+	}
+}
+
+// smooth replaces the placement score, eviction rate and discount of every
+// nodepool with their EWMA. Nodepools seen for the first time start from
+// their current values, nodepools that disappeared are forgotten.
+func (s *priorityStabilizer) smooth(cluster string, nodePools NodepoolMap, alpha float64) NodepoolMap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.inputs[cluster]
+	current := make(map[string]smoothedInputs, len(nodePools))
+	smoothed := make(NodepoolMap, len(nodePools))
+	for key, np := range nodePools {
+		in := smoothedInputs{
+			placementScore: float64(np.PlacementScore),
+			evictionRate:   np.EvictionRate,
+			discount:       np.Discount,
+		}
+		if prev, ok := previous[key]; ok {
+			in.placementScore = alpha*in.placementScore + (1-alpha)*prev.placementScore
+			in.evictionRate = alpha*in.evictionRate + (1-alpha)*prev.evictionRate
+			in.discount = alpha*in.discount + (1-alpha)*prev.discount
+		}
+		current[key] = in
+
+		np.PlacementScore = int(math.Round(in.placementScore))
+		np.EvictionRate = in.evictionRate
+		np.Discount = in.discount
+		smoothed[key] = np
+	}
+	s.inputs[cluster] = current
+
+	return smoothed
+}
+
+// stabilize holds back priority changes of a cluster, given and returned by
+// nodepool. Nodepools whose priority moved by less than MinDelta keep their
+// previous priority, and the previous priorities are kept altogether when the
+// ordering changes while it is younger than MinDwell. Added or removed
+// nodepools are always applied. Every suppressed change is counted by reason.
+func (s *priorityStabilizer) stabilize(cluster string, priorities map[string]int, sc StabilityConfig, now time.Time) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := maps.Clone(priorities)
+	prev, ok := s.applied[cluster]
+	if !ok || !sameNodepools(prev.priorities, current) {
+		s.applied[cluster] = appliedPriorities{priorities: current, changedAt: now}
+		return maps.Clone(current)
+	}
+
+	held := false
+	for key, priority := range current {
+		old := prev.priorities[key]
+		if priority != old && abs(priority-old) < sc.MinDelta {
+			current[key] = old
+			held = true
+		}
+	}
+	if held {
+		suppressedPriorityChangesMetric.WithLabelValues(cluster, "delta").Inc()
+	}
+
+	if maps.Equal(current, prev.priorities) {
+		return maps.Clone(prev.priorities)
+	}
+
+	// changedAt is when the ordering last changed, not any priority
+	changedAt := prev.changedAt
+	if !maps.Equal(ranks(current), ranks(prev.priorities)) {
+		if now.Sub(prev.changedAt) < sc.MinDwell {
+			lg.Infof("Keeping priorities of cluster %s for %s, the current ordering is younger than %s", cluster, prev.changedAt.Add(sc.MinDwell).Sub(now).Round(time.Second), sc.MinDwell)
+			suppressedPriorityChangesMetric.WithLabelValues(cluster, "dwell").Inc()
+			return maps.Clone(prev.priorities)
+		}
+		changedAt = now
+	}
+
+	s.applied[cluster] = appliedPriorities{priorities: current, changedAt: changedAt}
+	return maps.Clone(current)
+}
+
+// ranks replaces every priority with its dense rank, 1 for the lowest, so
+// that orderings compare equal whatever the priority values.
+func ranks(priorities map[string]int) map[string]int {
+	values := make([]int, 0, len(priorities))
+	for _, priority := range priorities {
+		values = append(values, priority)
+	}
+	sort.Ints(values)
+	values = slices.Compact(values)
+
+	result := make(map[string]int, len(priorities))
+	for key, priority := range priorities {
+		result[key] = sort.SearchInts(values, priority) + 1
+	}
+	return result
+}
+
+func sameNodepools(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmoothInputs(t *testing.T) {
+	s := newPriorityStabilizer()
+
+	first := s.smooth("prod", NodepoolMap{"spota": {Name: "spota", PlacementScore: 100, EvictionRate: 0.1, Discount: 0.8}}, 0.5)
+	assert.Equal(t, 100, first["spota"].PlacementScore)
+
+	second := s.smooth("prod", NodepoolMap{"spota": {Name: "spota", PlacementScore: 40, EvictionRate: 0.3, Discount: 0.6}}, 0.5)
+	assert.Equal(t, 70, second["spota"].PlacementScore)
+	assert.InDelta(t, 0.2, second["spota"].EvictionRate, 1e-9)
+	assert.InDelta(t, 0.7, second["spota"].Discount, 1e-9)
+
+	// Smoothing is kept per cluster
+	other := s.smooth("staging", NodepoolMap{"spota": {Name: "spota", PlacementScore: 40}}, 0.5)
+	assert.Equal(t, 40, other["spota"].PlacementScore)
+}
+
+func TestStabilizeMinDelta(t *testing.T) {
+	s := newPriorityStabilizer()
+	sc := StabilityConfig{Alpha: 1, MinDelta: 5}
+	now := time.Now()
+
+	initial := map[string]int{"spota": 50, "spotb": 46}
+	assert.Equal(t, initial, s.stabilize("prod", initial, sc, now))
+
+	// Small moves are held back, even when they swap the nodepools
+	swapped := map[string]int{"spota": 47, "spotb": 49}
+	assert.Equal(t, initial, s.stabilize("prod", swapped, sc, now.Add(time.Minute)))
+
+	moved := map[string]int{"spota": 30, "spotb": 48}
+	assert.Equal(t, map[string]int{"spota": 30, "spotb": 46}, s.stabilize("prod", moved, sc, now.Add(2*time.Minute)))
+}
+
+func TestStabilizeMinDwell(t *testing.T) {
+	s := newPriorityStabilizer()
+	sc := StabilityConfig{Alpha: 1, MinDwell: 10 * time.Minute}
+	now := time.Now()
+
+	initial := map[string]int{"spota": 50, "spotb": 40}
+	swapped := map[string]int{"spota": 40, "spotb": 50}
+	s.stabilize("prod", initial, sc, now)
+
+	assert.Equal(t, initial, s.stabilize("prod", swapped, sc, now.Add(5*time.Minute)))
+	assert.Equal(t, swapped, s.stabilize("prod", swapped, sc, now.Add(11*time.Minute)))
+
+	// Moves keeping the ordering are applied right away and do not restart the
+	// dwell
+	raised := map[string]int{"spota": 60, "spotb": 50}
+	assert.Equal(t, initial, s.stabilize("prod", initial, sc, now.Add(22*time.Minute)))
+	assert.Equal(t, raised, s.stabilize("prod", raised, sc, now.Add(30*time.Minute)))
+	assert.Equal(t, swapped, s.stabilize("prod", swapped, sc, now.Add(33*time.Minute)))
+
+	// New nodepools are applied right away
+	added := map[string]int{"spota": 50, "spotb": 40, "spotc": 30}
+	assert.Equal(t, added, s.stabilize("prod", added, sc, now.Add(34*time.Minute)))
+}
+
+func TestStabilizerFork(t *testing.T) {
+	s := newPriorityStabilizer()
+	sc := StabilityConfig{Alpha: 0.5, MinDwell: time.Hour}
+	now := time.Now()
+	s.smooth("prod", NodepoolMap{"spota": {Name: "spota", PlacementScore: 100}}, sc.Alpha)
+	s.stabilize("prod", map[string]int{"spota": 50, "spotb": 40}, sc, now)
+
+	// A fork that is not committed, such as a failed write, leaves no trace
+	f := s.fork("prod")
+	f.smooth("prod", NodepoolMap{"spota": {Name: "spota", PlacementScore: 0}}, sc.Alpha)
+	f.stabilize("prod", map[string]int{"spota": 50, "spotb": 40, "spotc": 30}, sc, now)
+	assert.Equal(t, 50, s.smooth("prod", NodepoolMap{"spota": {Name: "spota", PlacementScore: 0}}, sc.Alpha)["spota"].PlacementScore)
+	assert.Equal(t, map[string]int{"spota": 40, "spotb": 50}, s.stabilize("prod", map[string]int{"spota": 40, "spotb": 50}, sc, now.Add(2*time.Hour)))
+
+	f = s.fork("prod")
+	f.stabilize("prod", map[string]int{"spota": 50, "spotb": 40}, sc, now.Add(3*time.Hour))
+	s.commit("prod", f)
+	// The ordering committed at 3h is held for the dwell
+	assert.Equal(t, map[string]int{"spota": 50, "spotb": 40}, s.stabilize("prod", map[string]int{"spota": 40, "spotb": 50}, sc, now.Add(3*time.Hour+time.Minute)))
+}
+
+func TestUpdateConfigMapStability(t *testing.T) {
+	// Followers score and record the priorities without writing them
+	leadership.enabled.Store(true)
+	defer leadership.enabled.Store(false)
+	// The stabilizer and the API state are globals, swap in fresh ones so
+	// repeated runs start from the same state
+	prevStabilizer, prevLatest := stabilizer, latest
+	stabilizer = newPriorityStabilizer()
+	latest = &apiState{clusters: make(map[string]clusterSnapshot), skus: make(map[string]SKUStatus)}
+	t.Cleanup(func() { stabilizer, latest = prevStabilizer, prevLatest })
+
+	cfg := viper.New()
+	cfg.Set("smoothing.alpha", 0.5)
+	cfg.Set("hysteresis.min.dwell", "1h")
+	cluster := ClusterConfig{Name: "aks-stability-test"}
+
+	nodePools := NodepoolMap{
+		"spota": {Name: "spota", Type: "Spot", PlacementScore: 100},
+		"spotb": {Name: "spotb", Type: "Spot", PlacementScore: 25},
+	}
+	assert.NoError(t, updateConfigMap(context.Background(), cfg, cluster, nodePools))
+	assert.NoError(t, updateConfigMap(context.Background(), cfg, cluster, NodepoolMap{
+		"spota": {Name: "spota", Type: "Spot", PlacementScore: 25},
+		"spotb": {Name: "spotb", Type: "Spot", PlacementScore: 100},
+	}))
+
+	// The reordering is held back, the API shows the fetched inputs next to
+	// the smoothed ones
+	latest.mu.RLock()
+	snapshot := latest.clusters[cluster.Name]
+	latest.mu.RUnlock()
+	spota := snapshot.nodepools[0]
+	assert.Equal(t, 25, spota.PlacementScore)
+	assert.Equal(t, 63, spota.Smoothed.PlacementScore)
+	assert.Greater(t, *spota.Priority, *snapshot.nodepools[1].Priority)
+
+	// Pins are applied right away
+	pinned := 1
+	nodePools["spota"] = Nodepool{Name: "spota", Type: "Spot", PlacementScore: 25, Overrides: &NodepoolOverrides{Priority: &pinned, Source: "config"}}
+	nodePools["spotb"] = Nodepool{Name: "spotb", Type: "Spot", PlacementScore: 100}
+	assert.NoError(t, updateConfigMap(context.Background(), cfg, cluster, nodePools))
+	latest.mu.RLock()
+	snapshot = latest.clusters[cluster.Name]
+	latest.mu.RUnlock()
+	assert.Equal(t, 1, *snapshot.nodepools[0].Priority)
+}
+
+func TestNewStabilityConfig(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("smoothing.alpha", 0.3)
+	cfg.Set("hysteresis.min.delta", 5)
+	cfg.Set("hysteresis.min.dwell", "10m")
+	sc, err := newStabilityConfig(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, StabilityConfig{Alpha: 0.3, MinDelta: 5, MinDwell: 10 * time.Minute}, sc)
+
+	cfg.Set("smoothing.alpha", 0)
+	_, err = newStabilityConfig(cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/spf13/viper"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// apiError is returned for unsuccessful responses of the Azure APIs called
+// without an SDK client.
+type apiError struct {
+	api        string
+	statusCode int
+	status     string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s API error: %s", e.api, e.status)
+}
+
+// isTransient reports whether a reconcile error is worth retrying before the
+// next interval. Throttling, conflicts, server errors, network failures and
+// timeouts are transient, other client errors (bad credentials, missing
+// permissions or resources) are permanent. Errors that cannot be classified,
+// such as invalid config or a refused write, are permanent as retrying them
+// changes nothing. A joined error is permanent only when all of its errors
+// are.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if isTransient(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	statusCode := 0
+	var respErr *azcore.ResponseError
+	var authErr *azidentity.AuthenticationFailedError
+	var apiErr *apiError
+	var statusErr apierrors.APIStatus
+	switch {
+	case errors.As(err, &apiErr):
+		statusCode = apiErr.statusCode
+	case errors.As(err, &respErr):
+		statusCode = respErr.StatusCode
+	case errors.As(err, &authErr) && authErr.RawResponse != nil:
+		statusCode = authErr.RawResponse.StatusCode
+	case errors.As(err, &statusErr):
+		statusCode = int(statusErr.Status().Code)
+	}
+
+	if statusCode == 0 {
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusConflict || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// supervisor runs reconcile every interval, retrying transient failures with
+// jittered exponential backoff instead of exiting. Metrics and the last
+// written priorities are left in place while it retries. A receive on wake
+// runs reconcile right away.
+type supervisor struct {
+	cfg       *viper.Viper
+	reconcile func(ctx context.Context) error
+	wake      <-chan struct{}
+}
+
+func (s *supervisor) run(ctx context.Context) {
+	failures := 0
+	// Reconcile right away so readiness does not wait for a full interval
+	delay := time.Duration(0)
+
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		err := s.reconcile(ctx)
+		if err == nil {
+			failures = 0
+			delay = s.interval()
+			health.recordSuccess()
+			continue
+		}
+
+		failures++
+		transient := isTransient(err)
+		health.recordFailure(err, transient, failures)
+
+		if transient {
+			delay = s.backoff(failures)
+			lg.WithError(err).Warnf("Reconcile failed with a transient error, retrying in %s", delay)
+		} else {
+			delay = s.interval()
+			lg.WithError(err).Errorf("Reconcile failed with a permanent error, retrying in %s", delay)
+		}
+	}
+}
+
+func (s *supervisor) interval() time.Duration {
+	return time.Second * time.Duration(s.cfg.GetInt("time.interval"))
+}
+
+// backoff returns the delay before the given retry, doubling from
+// retry.backoff.base up to retry.backoff.max with the upper half jittered.
+func (s *supervisor) backoff(failures int) time.Duration {
+	base := s.cfg.GetDuration("retry.backoff.base")
+	maxDelay := s.cfg.GetDuration("retry.backoff.max")
+
+	delay := base
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	if delay <= 0 {
+		return s.interval()
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
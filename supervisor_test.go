@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "unclassified", err: errors.New("smoothing.alpha must be in (0, 1], got 2"), expected: false},
+		{name: "network", err: fmt.Errorf("failed to fetch prices: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), expected: true},
+		{name: "timeout", err: fmt.Errorf("failed to get nodepools: %w", context.DeadlineExceeded), expected: true},
+		{name: "kubernetes conflict", err: &apierrors.StatusError{ErrStatus: metav1.Status{Code: http.StatusConflict}}, expected: true},
+		{name: "kubernetes forbidden", err: &apierrors.StatusError{ErrStatus: metav1.Status{Code: http.StatusForbidden}}, expected: false},
+		{name: "throttled", err: &apiError{api: "placement score", statusCode: http.StatusTooManyRequests}, expected: true},
+		{name: "server error", err: fmt.Errorf("wrapped: %w", &apiError{statusCode: http.StatusBadGateway}), expected: true},
+		{name: "forbidden", err: &apiError{statusCode: http.StatusForbidden}, expected: false},
+		{name: "arm not found", err: fmt.Errorf("failed to get AKS cluster: %w", &azcore.ResponseError{StatusCode: http.StatusNotFound}), expected: false},
+		{name: "arm unavailable", err: &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable}, expected: true},
+		{name: "joined permanent", err: errors.Join(&apiError{statusCode: 401}, &apiError{statusCode: 404}), expected: false},
+		{name: "joined mixed", err: errors.Join(&apiError{statusCode: 401}, &apiError{statusCode: 503}), expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isTransient(tt.err))
+		})
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("time.interval", 120)
+	cfg.Set("retry.backoff.base", "10s")
+	cfg.Set("retry.backoff.max", "1m")
+	s := &supervisor{cfg: cfg}
+
+	for failures, expected := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 10: time.Minute} {
+		delay := s.backoff(failures)
+		assert.GreaterOrEqual(t, delay, expected/2)
+		assert.LessOrEqual(t, delay, expected)
+	}
+}
+
+func TestSupervisorRetriesTransientErrors(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("time.interval", 60)
+	cfg.Set("retry.backoff.base", "1ms")
+	cfg.Set("retry.backoff.max", "1ms")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	s := &supervisor{
+		cfg: cfg,
+		reconcile: func(ctx context.Context) error {
+			calls++
+			if calls == 4 {
+				cancel()
+				return nil
+			}
+			return &apiError{statusCode: http.StatusServiceUnavailable}
+		},
+	}
+	s.run(ctx)
+
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, 0, health.consecutiveFailures)
+	assert.False(t, health.lastSuccess.IsZero())
+}
+
+func TestSupervisorWake(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("time.interval", 3600)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wake := make(chan struct{}, 1)
+	calls := 0
+	s := &supervisor{
+		cfg: cfg,
+		reconcile: func(ctx context.Context) error {
+			calls++
+			if calls == 2 {
+				cancel()
+				return nil
+			}
+			wake <- struct{}{}
+			return nil
+		},
+		wake: wake,
+	}
+	s.run(ctx)
+
+	assert.Equal(t, 2, calls)
+}
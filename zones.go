@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var activeZoneAggregation = struct {
+	sync.RWMutex
+	method string
+}{
+	method: "mean",
+}
+
+// reloadZoneAggregation swaps in placement.zone.aggregation from the current
+// config. On error the previous method is kept.
+func reloadZoneAggregation(cfg *viper.Viper) error {
+	method := cfg.GetString("placement.zone.aggregation")
+	switch method {
+	case "min", "max", "mean", "weighted":
+	default:
+		return fmt.Errorf("unknown placement.zone.aggregation %q, expected min, max, mean or weighted", method)
+	}
+	activeZoneAggregation.Lock()
+	activeZoneAggregation.method = method
+	activeZoneAggregation.Unlock()
+	return nil
+}
+
+func currentZoneAggregation() string {
+	activeZoneAggregation.RLock()
+	defer activeZoneAggregation.RUnlock()
+	return activeZoneAggregation.method
+}
+
+// aggregatePlacementScores combines the per-zone placement scores of a
+// nodepool into a single score using one of min, max, mean or weighted.
+// weighted uses the current node count per zone and falls back to mean when
+// the nodepool has no nodes. Nodepools without zones are scored on every zone
+// the SKU reports.
+func aggregatePlacementScores(method string, scores map[string]int, zones []string, nodeCounts map[string]int) int {
+	if len(zones) == 0 {
+		for zone := range scores {
+			zones = append(zones, zone)
+		}
+		sort.Strings(zones)
+	}
+	if len(zones) == 0 {
+		return 0
+	}
+
+	switch method {
+	case "min":
+		result := scores[zones[0]]
+		for _, zone := range zones[1:] {
+			result = min(result, scores[zone])
+		}
+		return result
+	case "max":
+		result := scores[zones[0]]
+		for _, zone := range zones[1:] {
+			result = max(result, scores[zone])
+		}
+		return result
+	case "weighted":
+		var total, weighted float64
+		for _, zone := range zones {
+			total += float64(nodeCounts[zone])
+			weighted += float64(nodeCounts[zone] * scores[zone])
+		}
+		if total > 0 {
+			return int(math.Round(weighted / total))
+		}
+	}
+
+	var sum float64
+	for _, zone := range zones {
+		sum += float64(scores[zone])
+	}
+	return int(math.Round(sum / float64(len(zones))))
+}
+
+// countNodesPerZone returns the number of nodes per nodepool and availability
+// zone. Zone labels like "eastus-1" are reduced to the zone number used by the
+// placement score API.
+func countNodesPerZone(nodes []corev1.Node, nodepoolLabel, zoneLabel string) map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	for _, node := range nodes {
+		pool, ok := node.Labels[nodepoolLabel]
+		if !ok {
+			continue
+		}
+		zone := node.Labels[zoneLabel]
+		if i := strings.LastIndex(zone, "-"); i >= 0 {
+			zone = zone[i+1:]
+		}
+		if _, ok := counts[pool]; !ok {
+			counts[pool] = make(map[string]int)
+		}
+		counts[pool][zone]++
+	}
+
+	return counts
+}
+
+func clusterNodeCounts(ctx context.Context, cfg *viper.Viper, cluster ClusterConfig) (map[string]map[string]int, error) {
+	clientset, err := getK8SClientFor(cluster.Kubeconfig, cluster.Context)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return countNodesPerZone(nodes.Items, cfg.GetString("label.nodepool"), cfg.GetString("label.zone")), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAggregatePlacementScores(t *testing.T) {
+	scores := map[string]int{"1": 25, "2": 100, "3": 100}
+	zones := []string{"1", "2", "3"}
+	nodeCounts := map[string]int{"1": 3, "2": 1}
+
+	assert.Equal(t, 25, aggregatePlacementScores("min", scores, zones, nil))
+	assert.Equal(t, 100, aggregatePlacementScores("max", scores, zones, nil))
+	assert.Equal(t, 75, aggregatePlacementScores("mean", scores, zones, nil))
+	assert.Equal(t, 44, aggregatePlacementScores("weighted", scores, zones, nodeCounts))
+	// weighted falls back to mean without nodes
+	assert.Equal(t, 75, aggregatePlacementScores("weighted", scores, zones, nil))
+	// nodepools without zones are scored on every zone of the SKU
+	assert.Equal(t, 25, aggregatePlacementScores("min", scores, nil, nil))
+	assert.Equal(t, 100, aggregatePlacementScores("max", scores, []string{"2"}, nil))
+	assert.Equal(t, 0, aggregatePlacementScores("mean", nil, nil, nil))
+}
+
+func TestReloadZoneAggregation(t *testing.T) {
+	t.Cleanup(func() { activeZoneAggregation.method = "mean" })
+
+	cfg := viper.New()
+	cfg.Set("placement.zone.aggregation", "weighted")
+	assert.NoError(t, reloadZoneAggregation(cfg))
+	assert.Equal(t, "weighted", currentZoneAggregation())
+
+	// Unknown methods are rejected and the previous one is kept
+	cfg.Set("placement.zone.aggregation", "median")
+	assert.Error(t, reloadZoneAggregation(cfg))
+	assert.Equal(t, "weighted", currentZoneAggregation())
+}
+
+func TestCountNodesPerZone(t *testing.T) {
+	node := func(name, pool, zone string) corev1.Node {
+		return corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"agentpool": pool, "topology.kubernetes.io/zone": zone},
+		}}
+	}
+	nodes := []corev1.Node{
+		node("a-0", "spota", "eastus-1"),
+		node("a-1", "spota", "eastus-1"),
+		node("a-2", "spota", "eastus-3"),
+		node("b-0", "spotb", "0"),
+	}
+
+	counts := countNodesPerZone(nodes, "agentpool", "topology.kubernetes.io/zone")
+	assert.Equal(t, map[string]map[string]int{
+		"spota": {"1": 2, "3": 1},
+		"spotb": {"0": 1},
+	}, counts)
+}